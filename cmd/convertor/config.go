@@ -0,0 +1,535 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/accelerated-container-image/pkg/builder"
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of the file given by --config. Flags set on the
+// command line override it.
+type Config struct {
+	// Registries are keyed by host[:port]
+	Registries map[string]RegistryConfig `yaml:"registries"`
+	Network    NetworkConfig             `yaml:"network"`
+	Defaults   EngineConfig              `yaml:"defaults"`
+	Database   DatabaseConfig            `yaml:"database"`
+	// Profiles are selected by --profile, set fields override Defaults
+	Profiles map[string]EngineConfig `yaml:"profiles"`
+}
+
+type RegistryConfig struct {
+	PlainHTTP   bool       `yaml:"plainHTTP"`
+	Insecure    bool       `yaml:"insecure"`
+	CertDirs    []string   `yaml:"certDirs"`
+	RootCAs     []string   `yaml:"rootCAs"`
+	ClientCerts []string   `yaml:"clientCerts"` // ${cert-file}:${key-file}
+	Auth        AuthConfig `yaml:"auth"`
+	// Mirrors are tried in order before the registry to pull images
+	Mirrors []string `yaml:"mirrors"`
+	// rate limits of the registry (MB/s), overriding the per host limits
+	DownloadLimit int64 `yaml:"downloadLimit"`
+	UploadLimit   int64 `yaml:"uploadLimit"`
+}
+
+// AuthConfig tells where the credentials of a registry come from. At most one
+// of Password, PasswordEnv and PasswordFile can be set, the latter two keep
+// the secret out of the file.
+type AuthConfig struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordEnv  string `yaml:"passwordEnv"`
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+type NetworkConfig struct {
+	DownloadLimit         int64         `yaml:"downloadLimit"` // MB/s
+	UploadLimit           int64         `yaml:"uploadLimit"`
+	DownloadLimitPerHost  int64         `yaml:"downloadLimitPerHost"`
+	UploadLimitPerHost    int64         `yaml:"uploadLimitPerHost"`
+	MaxConnsPerHost       int           `yaml:"maxConnsPerHost"`
+	Proxy                 string        `yaml:"proxy"`
+	DialTimeout           time.Duration `yaml:"dialTimeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout"`
+}
+
+// EngineConfig holds the conversion options, unset fields keep the default
+// of the corresponding flag
+type EngineConfig struct {
+	OCI              *bool       `yaml:"oci"`
+	FsType           string      `yaml:"fstype"`
+	Vsize            int         `yaml:"vsize"`
+	Mkfs             *bool       `yaml:"mkfs"`
+	Sparse           *bool       `yaml:"sparse"`
+	ZFile            ZFileConfig `yaml:"zfile"`
+	Referrer         *bool       `yaml:"referrer"`
+	ConcurrencyLimit *int        `yaml:"concurrencyLimit"`
+}
+
+type ZFileConfig struct {
+	Algorithm string `yaml:"algorithm"` // lz4 or zstd
+	BlockSize int    `yaml:"blockSize"` // KB
+}
+
+// DatabaseConfig configures the deduplication database. At most one of DSN,
+// DSNEnv and DSNFile can be set.
+type DatabaseConfig struct {
+	Type    string `yaml:"type"`
+	DSN     string `yaml:"dsn"`
+	DSNEnv  string `yaml:"dsnEnv"`
+	DSNFile string `yaml:"dsnFile"`
+}
+
+// loadConfig reads the config file, fields unknown to Config are errors
+func loadConfig(fn string) (*Config, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse %s: %w", fn, err)
+	}
+	return cfg, nil
+}
+
+// engineConfig returns the defaults overridden by profile
+func (c *Config) engineConfig(profile string) (EngineConfig, error) {
+	ec := c.Defaults
+	if profile == "" {
+		return ec, nil
+	}
+	p, ok := c.Profiles[profile]
+	if !ok {
+		return ec, fmt.Errorf("profile %q is not defined", profile)
+	}
+	if p.OCI != nil {
+		ec.OCI = p.OCI
+	}
+	if p.FsType != "" {
+		ec.FsType = p.FsType
+	}
+	if p.Vsize != 0 {
+		ec.Vsize = p.Vsize
+	}
+	if p.Mkfs != nil {
+		ec.Mkfs = p.Mkfs
+	}
+	if p.Sparse != nil {
+		ec.Sparse = p.Sparse
+	}
+	if p.ZFile.Algorithm != "" {
+		ec.ZFile.Algorithm = p.ZFile.Algorithm
+	}
+	if p.ZFile.BlockSize != 0 {
+		ec.ZFile.BlockSize = p.ZFile.BlockSize
+	}
+	if p.Referrer != nil {
+		ec.Referrer = p.Referrer
+	}
+	if p.ConcurrencyLimit != nil {
+		ec.ConcurrencyLimit = p.ConcurrencyLimit
+	}
+	return ec, nil
+}
+
+// auth returns user:password of the registry
+func (r RegistryConfig) auth() (string, error) {
+	a := r.Auth
+	password := a.Password
+	switch {
+	case a.PasswordEnv != "":
+		v, ok := os.LookupEnv(a.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s of the password is not set", a.PasswordEnv)
+		}
+		password = v
+	case a.PasswordFile != "":
+		data, err := os.ReadFile(a.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file: %w", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+	if a.Username == "" {
+		return "", nil
+	}
+	return a.Username + ":" + password, nil
+}
+
+func (r RegistryConfig) options() (builder.RegistryOptions, error) {
+	auth, err := r.auth()
+	if err != nil {
+		return builder.RegistryOptions{}, err
+	}
+	return builder.RegistryOptions{
+		Auth:      auth,
+		PlainHTTP: r.PlainHTTP,
+		CertOption: builder.CertOption{
+			CertDirs:    r.CertDirs,
+			RootCAs:     r.RootCAs,
+			ClientCerts: r.ClientCerts,
+			Insecure:    r.Insecure,
+		},
+		Mirrors:           r.Mirrors,
+		DownloadRateLimit: r.DownloadLimit << 20,
+		UploadRateLimit:   r.UploadLimit << 20,
+	}, nil
+}
+
+// dsn returns the data source name of the database
+func (d DatabaseConfig) dsn() (string, error) {
+	switch {
+	case d.DSNEnv != "":
+		v, ok := os.LookupEnv(d.DSNEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s of the db dsn is not set", d.DSNEnv)
+		}
+		return v, nil
+	case d.DSNFile != "":
+		data, err := os.ReadFile(d.DSNFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read db dsn file: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	default:
+		return d.DSN, nil
+	}
+}
+
+// validate checks the config and profile, without accessing the secrets
+func (c *Config) validate(profile string) error {
+	var errs []error
+	add := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	checkFile := func(what, fn string) {
+		if _, err := os.Stat(fn); err != nil {
+			add("%s: %v", what, err)
+		}
+	}
+
+	hosts := make([]string, 0, len(c.Registries))
+	for host := range c.Registries {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		r := c.Registries[host]
+		prefix := "registries." + host
+		if strings.Contains(host, "/") {
+			add("%s: key should be a registry host[:port]", prefix)
+		}
+		n := 0
+		for _, v := range []string{r.Auth.Password, r.Auth.PasswordEnv, r.Auth.PasswordFile} {
+			if v != "" {
+				n++
+			}
+		}
+		if n > 1 {
+			add("%s.auth: at most one of password, passwordEnv and passwordFile can be set", prefix)
+		}
+		if n > 0 && r.Auth.Username == "" {
+			add("%s.auth: username is required with a password", prefix)
+		}
+		if r.Auth.PasswordFile != "" {
+			checkFile(prefix+".auth.passwordFile", r.Auth.PasswordFile)
+		}
+		for _, dir := range r.CertDirs {
+			checkFile(prefix+".certDirs", dir)
+		}
+		for _, ca := range r.RootCAs {
+			checkFile(prefix+".rootCAs", ca)
+		}
+		for _, pair := range r.ClientCerts {
+			cert, key, ok := strings.Cut(pair, ":")
+			if !ok {
+				add("%s.clientCerts: %q should form in ${cert-file}:${key-file}", prefix, pair)
+				continue
+			}
+			checkFile(prefix+".clientCerts", cert)
+			checkFile(prefix+".clientCerts", key)
+		}
+		for _, mirror := range r.Mirrors {
+			if mirror == "" || strings.Contains(mirror, "/") {
+				add("%s.mirrors: %q should be a registry host[:port]", prefix, mirror)
+			}
+		}
+		if r.DownloadLimit < 0 || r.UploadLimit < 0 {
+			add("%s: rate limits can't be negative", prefix)
+		}
+	}
+
+	nc := c.Network
+	if nc.DownloadLimit < 0 || nc.UploadLimit < 0 || nc.DownloadLimitPerHost < 0 || nc.UploadLimitPerHost < 0 {
+		add("network: rate limits can't be negative")
+	}
+	if nc.MaxConnsPerHost < 0 {
+		add("network.maxConnsPerHost can't be negative")
+	}
+	if nc.DialTimeout < 0 || nc.ResponseHeaderTimeout < 0 {
+		add("network: timeouts can't be negative")
+	}
+	if nc.Proxy != "" {
+		if _, err := url.Parse(nc.Proxy); err != nil {
+			add("network.proxy: %v", err)
+		}
+	}
+
+	engines := map[string]EngineConfig{"defaults": c.Defaults}
+	for name, p := range c.Profiles {
+		engines["profiles."+name] = p
+	}
+	for name, ec := range engines {
+		switch ec.FsType {
+		case "", "ext4", "erofs":
+		default:
+			add("%s.fstype: unsupported filesystem %q, expected ext4 or erofs", name, ec.FsType)
+		}
+		if ec.Vsize < 0 {
+			add("%s.vsize can't be negative", name)
+		}
+		switch ec.ZFile.Algorithm {
+		case "", "lz4", "zstd":
+		default:
+			add("%s.zfile.algorithm: unknown algorithm %q, expected lz4 or zstd", name, ec.ZFile.Algorithm)
+		}
+		switch ec.ZFile.BlockSize {
+		case 0, 4, 8, 16, 32, 64:
+		default:
+			add("%s.zfile.blockSize: invalid block size %d, expected 4, 8, 16, 32 or 64", name, ec.ZFile.BlockSize)
+		}
+		if ec.ConcurrencyLimit != nil && *ec.ConcurrencyLimit < 0 {
+			add("%s.concurrencyLimit can't be negative", name)
+		}
+	}
+	if profile != "" {
+		if _, ok := c.Profiles[profile]; !ok {
+			add("profile %q is not defined", profile)
+		}
+	}
+
+	db := c.Database
+	switch db.Type {
+	case "":
+		if db.DSN != "" || db.DSNEnv != "" || db.DSNFile != "" {
+			add("database: type is required with a dsn")
+		}
+	case "mysql":
+		n := 0
+		for _, v := range []string{db.DSN, db.DSNEnv, db.DSNFile} {
+			if v != "" {
+				n++
+			}
+		}
+		if n != 1 {
+			add("database: exactly one of dsn, dsnEnv and dsnFile should be set")
+		}
+		if db.DSNFile != "" {
+			checkFile("database.dsnFile", db.DSNFile)
+		}
+	default:
+		add("database.type: unknown type %q. Available: mysql", db.Type)
+	}
+
+	// map iteration above is random, keep the report stable
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// applyConfig loads --config and sets the flags not set on the command line
+// from it. The registry and database settings are returned in cfg and used by
+// builderOptions and the root command.
+func applyConfig(flags *pflag.FlagSet) error {
+	if configFile == "" {
+		if profile != "" {
+			return fmt.Errorf("--profile requires --config")
+		}
+		return nil
+	}
+	var err error
+	if cfg, err = loadConfig(configFile); err != nil {
+		return err
+	}
+	ec, err := cfg.engineConfig(profile)
+	if err != nil {
+		return err
+	}
+	set := func(name string, apply func()) {
+		if f := flags.Lookup(name); f != nil && !f.Changed {
+			apply()
+		}
+	}
+	if ec.OCI != nil {
+		set("oci", func() { oci = *ec.OCI })
+	}
+	if ec.FsType != "" {
+		set("fstype", func() { fsType = ec.FsType })
+	}
+	if ec.Vsize != 0 {
+		set("vsize", func() { vsize = ec.Vsize })
+	}
+	if ec.Mkfs != nil {
+		set("mkfs", func() { mkfs = *ec.Mkfs })
+	}
+	if ec.Sparse != nil {
+		set("disable-sparse", func() { disableSparse = !*ec.Sparse })
+	}
+	if ec.ZFile.Algorithm != "" {
+		set("zfile-algorithm", func() { zfileAlgorithm = ec.ZFile.Algorithm })
+	}
+	if ec.ZFile.BlockSize != 0 {
+		set("zfile-block-size", func() { zfileBlockSize = ec.ZFile.BlockSize })
+	}
+	if ec.Referrer != nil {
+		set("referrer", func() { referrer = *ec.Referrer })
+	}
+	if ec.ConcurrencyLimit != nil {
+		set("concurrency-limit", func() { concurrencyLimit = *ec.ConcurrencyLimit })
+	}
+
+	nc := cfg.Network
+	if nc.DownloadLimit != 0 {
+		set("download-limit", func() { downloadLimit = nc.DownloadLimit })
+	}
+	if nc.UploadLimit != 0 {
+		set("upload-limit", func() { uploadLimit = nc.UploadLimit })
+	}
+	if nc.DownloadLimitPerHost != 0 {
+		set("download-limit-per-host", func() { hostDownloadLimit = nc.DownloadLimitPerHost })
+	}
+	if nc.UploadLimitPerHost != 0 {
+		set("upload-limit-per-host", func() { hostUploadLimit = nc.UploadLimitPerHost })
+	}
+	if nc.MaxConnsPerHost != 0 {
+		set("max-conns-per-host", func() { maxConnsPerHost = nc.MaxConnsPerHost })
+	}
+	if nc.Proxy != "" {
+		set("proxy", func() { proxy = nc.Proxy })
+	}
+	if nc.DialTimeout != 0 {
+		set("dial-timeout", func() { dialTimeout = nc.DialTimeout })
+	}
+	if nc.ResponseHeaderTimeout != 0 {
+		set("response-header-timeout", func() { responseHeaderTimeout = nc.ResponseHeaderTimeout })
+	}
+
+	if cfg.Database.Type != "" {
+		set("db-type", func() { dbType = cfg.Database.Type })
+		if f := flags.Lookup("db-str"); f != nil && !f.Changed {
+			if dbstr, err = cfg.Database.dsn(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// registryOptions returns the options of the registries in the config, the
+// registry of --repository is overridden by the flags set on the command line
+func registryOptions(flags *pflag.FlagSet) (map[string]builder.RegistryOptions, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	registries := make(map[string]builder.RegistryOptions, len(cfg.Registries))
+	for host, r := range cfg.Registries {
+		ro, err := r.options()
+		if err != nil {
+			return nil, fmt.Errorf("registry %s: %w", host, err)
+		}
+		registries[host] = ro
+	}
+	refspec, err := reference.Parse(repo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository %q: %w", repo, err)
+	}
+	host := refspec.Hostname()
+	ro, ok := registries[host]
+	if !ok {
+		return registries, nil
+	}
+	changed := func(name string) bool {
+		f := flags.Lookup(name)
+		return f != nil && f.Changed
+	}
+	if changed("username") {
+		ro.Auth = user
+	}
+	if changed("plain") {
+		ro.PlainHTTP = plain
+	}
+	if changed("cert-dir") {
+		ro.CertDirs = certDirs
+	}
+	if changed("root-ca") {
+		ro.RootCAs = rootCAs
+	}
+	if changed("client-cert") {
+		ro.ClientCerts = clientCerts
+	}
+	if changed("insecure") {
+		ro.Insecure = insecure
+	}
+	registries[host] = ro
+	return registries, nil
+}
+
+var (
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Manage the convertor configuration file.",
+		// the config is checked by the subcommands instead of being applied
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	}
+
+	configValidateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Check the configuration file given by --config, and the profile given by --profile if set.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if configFile == "" {
+				logrus.Error("--config is required")
+				os.Exit(1)
+			}
+			c, err := loadConfig(configFile)
+			if err == nil {
+				err = c.validate(profile)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid config %s:\n%v\n", configFile, err)
+				os.Exit(1)
+			}
+			fmt.Printf("%s is valid\n", configFile)
+		},
+	}
+)
@@ -19,11 +19,17 @@ package main
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"os"
 	"os/signal"
+	"text/tabwriter"
+	"time"
 
-	"github.com/containerd/accelerated-container-image/cmd/convertor/builder"
-	"github.com/containerd/accelerated-container-image/cmd/convertor/database"
+	"github.com/containerd/accelerated-container-image/pkg/builder"
+	"github.com/containerd/accelerated-container-image/pkg/builder/prefetch"
+	"github.com/containerd/accelerated-container-image/pkg/database"
+	"github.com/containerd/accelerated-container-image/pkg/utils"
+	"github.com/docker/go-units"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/sirupsen/logrus"
 
@@ -52,12 +58,34 @@ var (
 	concurrencyLimit int
 	disableSparse    bool
 	referrer         bool
+	traceFile        string
+	priorityList     string
+	staticPrefetch   bool
+	listFile         string
+	cacheDir         string
+	cacheSize        int64
+	binDir           string
+	dryRun           bool
+	zfileAlgorithm   string
+	zfileBlockSize   int
+	configFile       string
+	profile          string
+	cfg              *Config
 
 	// certification
 	certDirs    []string
 	rootCAs     []string
 	clientCerts []string
 	insecure    bool
+	// network
+	downloadLimit         int64
+	uploadLimit           int64
+	hostDownloadLimit     int64
+	hostUploadLimit       int64
+	maxConnsPerHost       int
+	proxy                 string
+	dialTimeout           time.Duration
+	responseHeaderTimeout time.Duration
 	// debug
 	reserve      bool
 	noUpload     bool
@@ -70,15 +98,15 @@ var (
 Description: overlaybd convertor is a standalone userspace image conversion tool that helps converting oci images to overlaybd images.
 
 Version: ` + commitID,
-		Run: func(cmd *cobra.Command, args []string) {
-			if verbose {
-				logrus.SetLevel(logrus.DebugLevel)
-			}
-			tb := ""
-			if digestInput == "" && tagInput == "" {
-				logrus.Error("one of input-tag [-i] or input-digest [-g] is required")
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if err := applyConfig(cmd.Flags()); err != nil {
+				logrus.Errorf("failed to load config: %v", err)
 				os.Exit(1)
 			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			checkInput()
+			tb := ""
 			if overlaybd == "" && fastoci == "" && turboOCI == "" {
 				if tagOutput == "" {
 					logrus.Error("output-tag is required, you can specify it by [-o|--overlaybd|--turboOCI]")
@@ -96,34 +124,35 @@ Version: ` + commitID,
 			if referrer {
 				oci = true
 			}
-
-			ctx := context.Background()
-			ref := repo + ":" + tagInput
-			if tagInput == "" {
-				ref = repo + "@" + digestInput
+			if traceFile != "" && priorityList != "" {
+				logrus.Error("trace-file and priority-list can't be set at the same time")
+				os.Exit(1)
 			}
-			opt := builder.BuilderOptions{
-				Ref:       ref,
-				Auth:      user,
-				PlainHTTP: plain,
-				WorkDir:   dir,
-				OCI:       oci,
-				FsType:    fsType,
-				Mkfs:      mkfs,
-				Vsize:     vsize,
-				CertOption: builder.CertOption{
-					CertDirs:    certDirs,
-					RootCAs:     rootCAs,
-					ClientCerts: clientCerts,
-					Insecure:    insecure,
-				},
-				Reserve:          reserve,
-				NoUpload:         noUpload,
-				DumpManifest:     dumpManifest,
-				ConcurrencyLimit: concurrencyLimit,
-				DisableSparse:    disableSparse,
-				Referrer:         referrer,
+			if staticPrefetch && (traceFile != "" || priorityList != "") {
+				logrus.Error("static-prefetch can't be used with trace-file or priority-list")
+				os.Exit(1)
 			}
+
+			ctx := context.Background()
+			opt := builderOptions(cmd)
+			opt.OCI = oci
+			opt.FsType = fsType
+			opt.Mkfs = mkfs
+			opt.Vsize = vsize
+			opt.Reserve = reserve
+			opt.NoUpload = noUpload
+			opt.DumpManifest = dumpManifest
+			opt.ConcurrencyLimit = concurrencyLimit
+			opt.DisableSparse = disableSparse
+			opt.Referrer = referrer
+			opt.TraceFile = traceFile
+			opt.PriorityList = priorityList
+			opt.StaticPrefetch = staticPrefetch
+			opt.CacheDir = cacheDir
+			opt.CacheSize = cacheSize << 20
+			opt.OverlayBDBinDir = binDir
+			opt.ZFileAlgorithm = zfileAlgorithm
+			opt.ZFileBlockSize = zfileBlockSize
 			if overlaybd != "" {
 				logrus.Info("building [Overlaybd - Native]  image...")
 				opt.Engine = builder.Overlaybd
@@ -146,36 +175,172 @@ Version: ` + commitID,
 					logrus.Warnf("falling back to no deduplication")
 				}
 
-				if err := builder.Build(ctx, opt); err != nil {
+				if dryRun {
+					runDryRun(ctx, opt)
+				} else if err := builder.Build(ctx, opt); err != nil {
 					logrus.Errorf("failed to build overlaybd: %v", err)
 					os.Exit(1)
+				} else {
+					logrus.Info("overlaybd build finished")
 				}
-				logrus.Info("overlaybd build finished")
 			}
 			if tb != "" {
 				logrus.Info("building [Overlaybd - Turbo OCIv1] image...")
 				opt.Engine = builder.TurboOCI
 				opt.TargetRef = repo + ":" + tb
-				if err := builder.Build(ctx, opt); err != nil {
+				if dryRun {
+					runDryRun(ctx, opt)
+				} else if err := builder.Build(ctx, opt); err != nil {
 					logrus.Errorf("failed to build TurboOCIv1 image: %v", err)
 					os.Exit(1)
+				} else {
+					logrus.Info("TurboOCIv1 build finished")
 				}
-				logrus.Info("TurboOCIv1 build finished")
 			}
 		},
 	}
+
+	prefetchListCmd = &cobra.Command{
+		Use:   "prefetch-list",
+		Short: "Generate a priority list by analyzing the image entrypoint, without running it.",
+		Run: func(cmd *cobra.Command, args []string) {
+			checkInput()
+			list, err := builder.GeneratePriorityList(context.Background(), builderOptions(cmd))
+			if err != nil {
+				logrus.Errorf("failed to generate priority list: %v", err)
+				os.Exit(1)
+			}
+			if listFile == "" {
+				for _, f := range list {
+					fmt.Println(f)
+				}
+				return
+			}
+			if err := prefetch.WritePriorityList(listFile, list); err != nil {
+				logrus.Errorf("failed to write priority list: %v", err)
+				os.Exit(1)
+			}
+			logrus.Infof("%d files written to %s", len(list), listFile)
+		},
+	}
 )
 
+// runDryRun prints how the image would be converted by opt.Engine
+func runDryRun(ctx context.Context, opt builder.BuilderOptions) {
+	b, err := builder.NewBuilder(opt)
+	if err == nil {
+		var report *builder.DryRunReport
+		if report, err = b.DryRun(ctx); err == nil {
+			printDryRun(opt.Engine, report)
+			return
+		}
+	}
+	logrus.Errorf("failed to dry run %v: %v", opt.Engine, err)
+	os.Exit(1)
+}
+
+func printDryRun(engine builder.BuilderEngineType, report *builder.DryRunReport) {
+	size := func(n int64) string {
+		return units.HumanSize(float64(n))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "[%v]\n", engine)
+	for _, m := range report.Manifests {
+		platform := m.Platform
+		if platform == "" {
+			platform = "-"
+		}
+		if m.Converted != nil {
+			fmt.Fprintf(w, "manifest %s (%s): reuse %s\n", m.Source.Digest, platform, m.Converted.Digest)
+			continue
+		}
+		fmt.Fprintf(w, "manifest %s (%s):\n", m.Source.Digest, platform)
+		fmt.Fprintln(w, "  LAYER\tCHAINID\tACTION\tCOMPRESSION\tSIZE\tUNCOMPRESSED\tDOWNLOAD\tESTIMATED")
+		for idx, l := range m.Layers {
+			action := "convert"
+			switch {
+			case l.Cached:
+				action = "reuse (cache)"
+			case l.Reused():
+				action = "reuse"
+			}
+			fmt.Fprintf(w, "  %d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", idx, l.ChainID, action, l.Compression,
+				size(l.Source.Size), size(l.UncompressedSize), size(l.Download), size(l.EstimatedSize))
+		}
+	}
+	w.Flush()
+	s := report.Summary()
+	fmt.Printf("manifests: %d, reused: %d\n", s.Manifests, s.ReusedManifests)
+	fmt.Printf("layers: %d, reused: %d (%.1f%%)\n", s.Layers, s.ReusedLayers, s.LayerHitRate()*100)
+	fmt.Printf("source: %s, uncompressed: %s\n", size(s.SourceSize), size(s.UncompressedSize))
+	fmt.Printf("estimated download: %s, converted size: %s, new data: %s\n", size(s.Download), size(s.ConvertedSize), size(s.NewSize))
+}
+
+// checkInput validates the flags shared by all commands
+func checkInput() {
+	if verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	if repo == "" {
+		logrus.Error("repository [-r] is required")
+		os.Exit(1)
+	}
+	if digestInput == "" && tagInput == "" {
+		logrus.Error("one of input-tag [-i] or input-digest [-g] is required")
+		os.Exit(1)
+	}
+}
+
+// builderOptions returns the options shared by all commands
+func builderOptions(cmd *cobra.Command) builder.BuilderOptions {
+	ref := repo + ":" + tagInput
+	if tagInput == "" {
+		ref = repo + "@" + digestInput
+	}
+	registries, err := registryOptions(cmd.Flags())
+	if err != nil {
+		logrus.Errorf("failed to load registries from config: %v", err)
+		os.Exit(1)
+	}
+	return builder.BuilderOptions{
+		Ref:       ref,
+		Auth:      user,
+		PlainHTTP: plain,
+		WorkDir:   dir,
+		CertOption: builder.CertOption{
+			CertDirs:    certDirs,
+			RootCAs:     rootCAs,
+			ClientCerts: clientCerts,
+			Insecure:    insecure,
+		},
+		NetworkOptions: builder.NetworkOptions{
+			DownloadRateLimit:        downloadLimit << 20,
+			UploadRateLimit:          uploadLimit << 20,
+			PerHostDownloadRateLimit: hostDownloadLimit << 20,
+			PerHostUploadRateLimit:   hostUploadLimit << 20,
+			MaxConnsPerHost:          maxConnsPerHost,
+			Proxy:                    proxy,
+			DialTimeout:              dialTimeout,
+			ResponseHeaderTimeout:    responseHeaderTimeout,
+		},
+		Registries: registries,
+	}
+}
+
 func init() {
+	rootCmd.PersistentFlags().SortFlags = false
+	rootCmd.PersistentFlags().StringVarP(&repo, "repository", "r", "", "repository for converting image (required)")
+	rootCmd.PersistentFlags().StringVarP(&user, "username", "u", "", "user[:password] Registry user and password")
+	rootCmd.PersistentFlags().BoolVarP(&plain, "plain", "", false, "connections using plain HTTP")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "", false, "show debug log")
+	rootCmd.PersistentFlags().StringVarP(&tagInput, "input-tag", "i", "", "tag for image converting from (required when input-digest is not set)")
+	rootCmd.PersistentFlags().StringVarP(&digestInput, "input-digest", "g", "", "digest for image converting from (required when input-tag is not set)")
+	rootCmd.PersistentFlags().StringVarP(&dir, "dir", "d", "tmp_conv", "directory used for temporary data")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "path of the convertor config file, flags set on the command line override it")
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "name of the profile in the config file to convert with")
+
 	rootCmd.Flags().SortFlags = false
-	rootCmd.Flags().StringVarP(&repo, "repository", "r", "", "repository for converting image (required)")
-	rootCmd.Flags().StringVarP(&user, "username", "u", "", "user[:password] Registry user and password")
-	rootCmd.Flags().BoolVarP(&plain, "plain", "", false, "connections using plain HTTP")
-	rootCmd.Flags().BoolVarP(&verbose, "verbose", "", false, "show debug log")
-	rootCmd.Flags().StringVarP(&tagInput, "input-tag", "i", "", "tag for image converting from (required when input-digest is not set)")
-	rootCmd.Flags().StringVarP(&digestInput, "input-digest", "g", "", "digest for image converting from (required when input-tag is not set)")
 	rootCmd.Flags().StringVarP(&tagOutput, "output-tag", "o", "", "tag for image converting to")
-	rootCmd.Flags().StringVarP(&dir, "dir", "d", "tmp_conv", "directory used for temporary data")
 	rootCmd.Flags().BoolVarP(&oci, "oci", "", false, "export image with oci spec")
 	rootCmd.Flags().StringVar(&fsType, "fstype", "ext4", "filesystem type of converted image.")
 	rootCmd.Flags().BoolVarP(&mkfs, "mkfs", "", true, "make ext4 fs in bottom layer")
@@ -185,22 +350,45 @@ func init() {
 	rootCmd.Flags().StringVar(&overlaybd, "overlaybd", "", "build overlaybd format")
 	rootCmd.Flags().StringVar(&dbstr, "db-str", "", "db str for overlaybd conversion")
 	rootCmd.Flags().StringVar(&dbType, "db-type", "", "type of db to use for conversion deduplication. Available: mysql. Default none")
+	rootCmd.Flags().StringVar(&cacheDir, "cache-dir", "", "directory to cache converted layers across runs, can be shared by convertor processes on the same host")
+	rootCmd.Flags().Int64Var(&cacheSize, "cache-size", 10240, "max size of cache-dir (MB), least recently used layers are removed, 0 means no limit")
+	rootCmd.Flags().StringVar(&binDir, "overlaybd-bin-dir", utils.DefaultOverlayBDBinDir, "directory of overlaybd-create, overlaybd-apply, overlaybd-commit and turboOCI-apply")
 	rootCmd.Flags().IntVar(&concurrencyLimit, "concurrency-limit", 4, "the number of manifests that can be built at the same time, used for multi-arch images, 0 means no limit")
+	rootCmd.Flags().StringVar(&zfileAlgorithm, "zfile-algorithm", "", "compression algorithm of zfile, lz4 or zstd, default by overlaybd-commit")
+	rootCmd.Flags().IntVar(&zfileBlockSize, "zfile-block-size", 0, "compression block size of zfile (KB), 4, 8, 16, 32 or 64, default by overlaybd-commit")
 	rootCmd.Flags().BoolVar(&disableSparse, "disable-sparse", false, "disable sparse file for overlaybd")
 	rootCmd.Flags().BoolVar(&referrer, "referrer", false, "push converted manifests with subject, note '--oci' will be enabled automatically if '--referrer' is set, cause the referrer must be in OCI format.")
+	rootCmd.Flags().StringVar(&traceFile, "trace-file", "", "path of a recorded trace file, added to the converted image as acceleration layer")
+	rootCmd.Flags().StringVar(&priorityList, "priority-list", "", "path of a file-list contains files to be prefetched, added to the converted image as acceleration layer")
+	rootCmd.Flags().BoolVar(&staticPrefetch, "static-prefetch", false, "generate the priority list by analyzing the image entrypoint, added to the converted image as acceleration layer")
 
 	// certification
-	rootCmd.Flags().StringArrayVar(&certDirs, "cert-dir", nil, "In these directories, root CA should be named as *.crt and client cert should be named as *.cert, *.key")
-	rootCmd.Flags().StringArrayVar(&rootCAs, "root-ca", nil, "root CA certificates")
-	rootCmd.Flags().StringArrayVar(&clientCerts, "client-cert", nil, "client cert certificates, should form in ${cert-file}:${key-file}")
-	rootCmd.Flags().BoolVarP(&insecure, "insecure", "", false, "don't verify the server's certificate chain and host name")
+	rootCmd.PersistentFlags().StringArrayVar(&certDirs, "cert-dir", nil, "In these directories, root CA should be named as *.crt and client cert should be named as *.cert, *.key")
+	rootCmd.PersistentFlags().StringArrayVar(&rootCAs, "root-ca", nil, "root CA certificates")
+	rootCmd.PersistentFlags().StringArrayVar(&clientCerts, "client-cert", nil, "client cert certificates, should form in ${cert-file}:${key-file}")
+	rootCmd.PersistentFlags().BoolVarP(&insecure, "insecure", "", false, "don't verify the server's certificate chain and host name")
+
+	// network
+	rootCmd.PersistentFlags().Int64Var(&downloadLimit, "download-limit", 0, "max total download rate (MB/s), 0 means no limit")
+	rootCmd.PersistentFlags().Int64Var(&uploadLimit, "upload-limit", 0, "max total upload rate (MB/s), 0 means no limit")
+	rootCmd.PersistentFlags().Int64Var(&hostDownloadLimit, "download-limit-per-host", 0, "max download rate from each registry host (MB/s), 0 means no limit")
+	rootCmd.PersistentFlags().Int64Var(&hostUploadLimit, "upload-limit-per-host", 0, "max upload rate to each registry host (MB/s), 0 means no limit")
+	rootCmd.PersistentFlags().IntVar(&maxConnsPerHost, "max-conns-per-host", 32, "max connections to each registry host")
+	rootCmd.PersistentFlags().StringVar(&proxy, "proxy", "", "URL of the http proxy, HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used if not set")
+	rootCmd.PersistentFlags().DurationVar(&dialTimeout, "dial-timeout", 30*time.Second, "timeout of connecting to a registry")
+	rootCmd.PersistentFlags().DurationVar(&responseHeaderTimeout, "response-header-timeout", 0, "timeout of waiting for the response headers of a request, 0 means no limit")
+
+	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "report the layers which would be reused or converted, and the estimated sizes, without converting or pushing anything")
 
 	// debug
 	rootCmd.Flags().BoolVar(&reserve, "reserve", false, "reserve tmp data")
 	rootCmd.Flags().BoolVar(&noUpload, "no-upload", false, "don't upload layer and manifest")
 	rootCmd.Flags().BoolVar(&dumpManifest, "dump-manifest", false, "dump manifest")
 
-	rootCmd.MarkFlagRequired("repository")
+	prefetchListCmd.Flags().StringVarP(&listFile, "file", "f", "", "output file of the priority list, print to stdout if not set")
+	rootCmd.AddCommand(prefetchListCmd)
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
 }
 
 func main() {
@@ -14,6 +14,25 @@
    limitations under the License.
 */
 
+// Package builder converts OCI and docker images into overlaybd or turboOCI
+// images in userspace, pulling the source image from a registry and pushing
+// the result to another tag or repository.
+//
+// A minimal conversion looks like:
+//
+//	b, err := builder.NewBuilder(builder.BuilderOptions{
+//		Ref:       "registry.example.com/app:latest",
+//		TargetRef: "registry.example.com/app:latest_obd",
+//		WorkDir:   "/tmp/conversion",
+//		Engine:    builder.Overlaybd,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	err = b.Build(ctx)
+//
+// Registry access, deduplication and logging can be customized through
+// BuilderOptions, and other output formats can be added by RegisterEngine.
 package builder
 
 import (
@@ -33,21 +52,25 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/containerd/accelerated-container-image/cmd/convertor/database"
+	"github.com/containerd/accelerated-container-image/pkg/builder/cache"
+	"github.com/containerd/accelerated-container-image/pkg/builder/prefetch"
+	"github.com/containerd/accelerated-container-image/pkg/database"
+	"github.com/containerd/accelerated-container-image/pkg/utils"
 	"github.com/containerd/containerd/v2/core/images"
 	"github.com/containerd/containerd/v2/core/remotes"
 	"github.com/containerd/containerd/v2/core/remotes/docker"
 	"github.com/containerd/containerd/v2/pkg/reference"
 	"github.com/containerd/log"
 	"github.com/containerd/platforms"
+	"github.com/docker/go-units"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
 type BuilderOptions struct {
+	// Ref is the source image, TargetRef is where the result is pushed to
 	Ref       string
 	TargetRef string
 	Auth      string
@@ -60,6 +83,11 @@ type BuilderOptions struct {
 	DB        database.ConversionDatabase
 	Engine    BuilderEngineType
 	CertOption
+	NetworkOptions
+
+	// Registries overrides Auth, PlainHTTP, CertOption and the per host rate
+	// limits for some registry hosts, keyed by host[:port]
+	Registries   map[string]RegistryOptions
 	Reserve      bool
 	NoUpload     bool
 	DumpManifest bool
@@ -71,15 +99,175 @@ type BuilderOptions struct {
 	// disable sparse file when converting overlaybd
 	DisableSparse bool
 
+	// ZFileAlgorithm (lz4 or zstd) and ZFileBlockSize (in KB, a power of two
+	// between 4 and 64) set the compression of overlaybd layers, empty and 0
+	// mean the defaults of overlaybd-commit
+	ZFileAlgorithm string
+	ZFileBlockSize int
+
 	// Push manifests with subject
 	Referrer bool
-}
 
-type graphBuilder struct {
-	// required
+	// TraceFile or PriorityList is packed into an acceleration layer on top
+	// of the converted image, at most one of them can be set
+	TraceFile    string
+	PriorityList string
+
+	// StaticPrefetch generates the priority list of the acceleration layer by
+	// analyzing the image entrypoint, see package prefetch
+	StaticPrefetch bool
+
+	// CacheDir keeps converted layer files across runs, shared by convertor
+	// processes on the same host, empty means disabled. CacheSize limits its
+	// size in bytes, 0 means no limit.
+	CacheDir  string
+	CacheSize int64
+
+	// OverlayBDBinDir contains overlaybd-create, overlaybd-apply,
+	// overlaybd-commit and turboOCI-apply. If empty, the directory set by
+	// utils.SetOverlayBDBinDir is used, /opt/overlaybd/bin by default.
+	OverlayBDBinDir string
+
+	// Resolver is used to access the registries. If nil, a docker resolver is
+	// created by NewResolver.
 	Resolver remotes.Resolver
 
-	// options
+	// HTTPClient is used by the resolver created by NewResolver, the TLS
+	// settings of CertOption don't apply to it. If nil, a default client is
+	// created.
+	HTTPClient *http.Client
+
+	// Logger receives the logs of the conversion. If nil, the logger of the
+	// context passed to Build is used.
+	Logger *log.Entry
+
+	// OnLayerProgress is called when a layer reaches a stage of the
+	// conversion. It may be called concurrently, and should return quickly.
+	OnLayerProgress func(ctx context.Context, progress LayerProgress)
+
+	// OnComplete is called when the conversion of an image manifest or index
+	// is done, err is nil on success. It may be called concurrently.
+	OnComplete func(ctx context.Context, src, target v1.Descriptor, err error)
+}
+
+// LayerStage is a stage of the conversion of a layer
+type LayerStage int
+
+const (
+	// LayerDownloaded means the source layer has been downloaded
+	LayerDownloaded LayerStage = iota
+	// LayerReused means a previously converted layer has been found in the
+	// database or local cache, and will be used instead of converting it
+	LayerReused
+	// LayerConverted means the layer has been converted, or prepared for
+	// being reused
+	LayerConverted
+	// LayerUploaded means the converted layer has been pushed
+	LayerUploaded
+)
+
+func (s LayerStage) String() string {
+	switch s {
+	case LayerDownloaded:
+		return "downloaded"
+	case LayerReused:
+		return "reused"
+	case LayerConverted:
+		return "converted"
+	case LayerUploaded:
+		return "uploaded"
+	default:
+		return fmt.Sprintf("LayerStage(%d)", int(s))
+	}
+}
+
+// LayerProgress reports the stage of a layer of an image manifest
+type LayerProgress struct {
+	// Manifest is the source manifest being converted
+	Manifest v1.Descriptor
+	// Index is the position of the layer in the source manifest
+	Index int
+	// Layer is the source layer
+	Layer v1.Descriptor
+	Stage LayerStage
+}
+
+// Builder converts an image, or every platform of an image index. A Builder
+// can be used for several conversions, but not concurrently.
+type Builder struct {
+	opt    BuilderOptions
+	limits *transferLimits
+	stats  TransferStats
+}
+
+// NewBuilder validates opt and creates a Builder
+func NewBuilder(opt BuilderOptions) (*Builder, error) {
+	if opt.TraceFile != "" && opt.PriorityList != "" {
+		return nil, fmt.Errorf("trace file and priority list can't be set at the same time")
+	}
+	if opt.StaticPrefetch && (opt.TraceFile != "" || opt.PriorityList != "") {
+		return nil, fmt.Errorf("static prefetch can't be used with trace file or priority list")
+	}
+	if _, ok := lookupEngine(opt.Engine); !ok {
+		return nil, fmt.Errorf("unknown engine %v", opt.Engine)
+	}
+	if err := opt.NetworkOptions.validate(); err != nil {
+		return nil, err
+	}
+	for host, ro := range opt.Registries {
+		if ro.DownloadRateLimit < 0 || ro.UploadRateLimit < 0 {
+			return nil, fmt.Errorf("registry %s: rate limits can't be negative", host)
+		}
+	}
+	switch opt.ZFileAlgorithm {
+	case "", "lz4", "zstd":
+	default:
+		return nil, fmt.Errorf("unknown zfile algorithm %q, expected lz4 or zstd", opt.ZFileAlgorithm)
+	}
+	switch opt.ZFileBlockSize {
+	case 0, 4, 8, 16, 32, 64:
+	default:
+		return nil, fmt.Errorf("invalid zfile block size %d, expected 4, 8, 16, 32 or 64", opt.ZFileBlockSize)
+	}
+	if opt.Resolver == nil {
+		resolver, err := NewResolver(opt)
+		if err != nil {
+			return nil, err
+		}
+		opt.Resolver = resolver
+	}
+	if opt.OverlayBDBinDir != "" {
+		utils.SetOverlayBDBinDir(opt.OverlayBDBinDir)
+	}
+	return &Builder{opt: opt, limits: newTransferLimits(opt.NetworkOptions, opt.Registries)}, nil
+}
+
+// Build converts opt.Ref and pushes the result to opt.TargetRef
+func (b *Builder) Build(ctx context.Context) error {
+	if b.opt.Logger != nil {
+		ctx = log.WithLogger(ctx, b.opt.Logger)
+	}
+	counter := newTransferCounter()
+	err := (&graphBuilder{
+		BuilderOptions: b.opt,
+		limits:         b.limits,
+		counter:        counter,
+	}).Build(ctx)
+	b.stats = counter.stats()
+	log.G(ctx).Infof("downloaded %s (%s/s), uploaded %s (%s/s) in %s",
+		units.HumanSize(float64(b.stats.Downloaded)), units.HumanSize(b.stats.DownloadThroughput()),
+		units.HumanSize(float64(b.stats.Uploaded)), units.HumanSize(b.stats.UploadThroughput()),
+		b.stats.Duration.Round(time.Millisecond))
+	return err
+}
+
+// Stats returns the bytes transferred by the last Build and its throughput
+func (b *Builder) Stats() TransferStats {
+	return b.stats
+}
+
+type graphBuilder struct {
+	// options, Resolver is required
 	BuilderOptions
 
 	// private
@@ -89,6 +277,15 @@ type graphBuilder struct {
 	group     *errgroup.Group
 	sem       chan struct{}
 	id        atomic.Int32
+	cache     *cache.Cache
+
+	// limits and counter wrap fetcher and pushers, nil means disabled
+	limits  *transferLimits
+	counter *transferCounter
+
+	// dryRun collects the plans of manifests instead of converting them, nil
+	// means a normal conversion
+	dryRun *dryRunCollector
 }
 
 func (b *graphBuilder) Build(ctx context.Context) error {
@@ -104,9 +301,27 @@ func (b *graphBuilder) Build(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to obtain new tag pusher: %w", err)
 	}
+	if b.limits != nil {
+		srcHost, err := refHost(b.Ref)
+		if err != nil {
+			return err
+		}
+		targetHost, err := refHost(b.TargetRef)
+		if err != nil {
+			return err
+		}
+		fetcher = b.limits.fetcher(fetcher, srcHost, b.counter)
+		pusher = b.limits.pusher(pusher, targetHost, b.counter)
+		tagPusher = b.limits.pusher(tagPusher, targetHost, b.counter)
+	}
 	b.fetcher = fetcher
 	b.pusher = pusher
 	b.tagPusher = tagPusher
+	if b.CacheDir != "" {
+		if b.cache, err = cache.New(b.CacheDir, b.CacheSize); err != nil {
+			return err
+		}
+	}
 	_, src, err := b.Resolver.Resolve(ctx, b.Ref)
 	if err != nil {
 		return fmt.Errorf("failed to resolve: %w", err)
@@ -122,6 +337,9 @@ func (b *graphBuilder) Build(ctx context.Context) error {
 		if err != nil {
 			return fmt.Errorf("failed to build %q: %w", src.Digest, err)
 		}
+		if b.dryRun != nil {
+			return nil
+		}
 		log.G(gctx).Infof("converted to %q, digest: %q", b.TargetRef, target.Digest)
 		return nil
 	})
@@ -129,6 +347,14 @@ func (b *graphBuilder) Build(ctx context.Context) error {
 }
 
 func (b *graphBuilder) process(ctx context.Context, src v1.Descriptor, tag bool) (v1.Descriptor, error) {
+	target, err := b.convert(ctx, src, tag)
+	if b.OnComplete != nil && b.dryRun == nil {
+		b.OnComplete(ctx, src, target, err)
+	}
+	return target, err
+}
+
+func (b *graphBuilder) convert(ctx context.Context, src v1.Descriptor, tag bool) (v1.Descriptor, error) {
 	switch src.MediaType {
 	case v1.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
 		return b.buildOne(ctx, src, tag)
@@ -165,6 +391,9 @@ func (b *graphBuilder) process(ctx context.Context, src v1.Descriptor, tag bool)
 		if ctx.Err() != nil {
 			return v1.Descriptor{}, ctx.Err()
 		}
+		if b.dryRun != nil {
+			return src, nil
+		}
 
 		// upload index
 		if b.Referrer {
@@ -268,17 +497,52 @@ func (b *graphBuilder) buildOne(ctx context.Context, src v1.Descriptor, tag bool
 	}
 	engineBase.host = refspec.Hostname()
 	engineBase.repository = strings.TrimPrefix(refspec.Locator, engineBase.host+"/")
+	if b.DB != nil && b.dryRun == nil {
+		engineBase.leases = database.NewLayerLeases(b.DB, engineBase.host)
+	}
+	engineBase.dryRun = b.dryRun != nil
 	engineBase.reserve = b.Reserve
 	engineBase.noUpload = b.NoUpload
 	engineBase.dumpManifest = b.DumpManifest
+	engineBase.cache = b.cache
+	engineBase.accelLayerFile = b.TraceFile
+	if b.PriorityList != "" {
+		engineBase.accelLayerFile = b.PriorityList
+	}
 
-	var engine builderEngine
-	switch b.Engine {
-	case Overlaybd:
-		engine = NewOverlayBDBuilderEngine(engineBase)
-		engine.(*overlaybdBuilderEngine).disableSparse = b.DisableSparse
-	case TurboOCI:
-		engine = NewTurboOCIBuilderEngine(engineBase)
+	if b.StaticPrefetch && engineBase.accelLayerFile == "" && b.dryRun == nil {
+		list, err := prefetch.GeneratePriorityList(ctx, b.fetcher, *manifest, *config, filepath.Join(workdir, "prefetch"))
+		if err != nil {
+			return v1.Descriptor{}, fmt.Errorf("failed to generate priority list: %w", err)
+		}
+		if len(list) == 0 {
+			log.G(ctx).Warn("no file found for static prefetch, skip acceleration layer")
+		} else {
+			file := filepath.Join(workdir, "priority_list")
+			if err := prefetch.WritePriorityList(file, list); err != nil {
+				return v1.Descriptor{}, fmt.Errorf("failed to write priority list: %w", err)
+			}
+			log.G(ctx).Infof("%d files found for static prefetch", len(list))
+			engineBase.accelLayerFile = file
+		}
+	}
+
+	r, ok := lookupEngine(b.Engine)
+	if !ok {
+		return v1.Descriptor{}, fmt.Errorf("unknown engine %v", b.Engine)
+	}
+	engine, err := r.factory(ctx, engineBase, &b.BuilderOptions)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to create %v engine: %w", b.Engine, err)
+	}
+
+	if b.dryRun != nil {
+		report, err := b.planOne(ctx, engine, engineBase, src, platform)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		b.dryRun.add(report)
+		return src, nil
 	}
 
 	// build
@@ -286,6 +550,16 @@ func (b *graphBuilder) buildOne(ctx context.Context, src v1.Descriptor, tag bool
 		layers: len(engineBase.manifest.Layers),
 		engine: engine,
 	}
+	if b.OnLayerProgress != nil {
+		builder.progress = func(ctx context.Context, idx int, stage LayerStage) {
+			b.OnLayerProgress(ctx, LayerProgress{
+				Manifest: src,
+				Index:    idx,
+				Layer:    manifest.Layers[idx],
+				Stage:    stage,
+			})
+		}
+	}
 	desc, err := builder.Build(ctx)
 	if err != nil {
 		return v1.Descriptor{}, fmt.Errorf("failed to build %s: %w", workdir, err)
@@ -298,57 +572,117 @@ func (b *graphBuilder) buildOne(ctx context.Context, src v1.Descriptor, tag bool
 	return src, nil
 }
 
+// Build converts opt.Ref and pushes the result to opt.TargetRef, it's a
+// shortcut of NewBuilder and Builder.Build
 func Build(ctx context.Context, opt BuilderOptions) error {
-	tlsConfig, err := loadTLSConfig(opt.CertOption)
+	b, err := NewBuilder(opt)
+	if err != nil {
+		return err
+	}
+	return b.Build(ctx)
+}
+
+// GeneratePriorityList analyzes the entrypoint of opt.Ref and returns the files
+// needed to start it, see package prefetch
+func GeneratePriorityList(ctx context.Context, opt BuilderOptions) ([]string, error) {
+	if err := opt.NetworkOptions.validate(); err != nil {
+		return nil, err
+	}
+	resolver := opt.Resolver
+	if resolver == nil {
+		var err error
+		if resolver, err = NewResolver(opt); err != nil {
+			return nil, err
+		}
+	}
+	fetcher, err := resolver.Fetcher(ctx, opt.Ref)
 	if err != nil {
-		return fmt.Errorf("failed to load certifications: %w", err)
+		return nil, fmt.Errorf("failed to obtain new fetcher: %w", err)
+	}
+	_, src, err := resolver.Resolve(ctx, opt.Ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve: %w", err)
+	}
+	host, err := refHost(opt.Ref)
+	if err != nil {
+		return nil, err
+	}
+	fetcher = newTransferLimits(opt.NetworkOptions, opt.Registries).fetcher(fetcher, host, newTransferCounter())
+	manifest, config, err := fetchManifestAndConfig(ctx, fetcher, src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest and config: %w", err)
+	}
+	return prefetch.GeneratePriorityList(ctx, fetcher, *manifest, *config, filepath.Join(opt.WorkDir, "prefetch"))
+}
+
+// NewResolver creates a docker resolver with the auth, plain http and
+// certification settings of opt, overridden by opt.Registries for some hosts,
+// using opt.HTTPClient if set
+func NewResolver(opt BuilderOptions) (remotes.Resolver, error) {
+	hosts, err := newRegistryHosts(opt)
+	if err != nil {
+		return nil, err
+	}
+	return docker.NewResolver(docker.ResolverOptions{Hosts: hosts.hosts}), nil
+}
+
+func newHTTPClient(opt CertOption, netOpt NetworkOptions) (*http.Client, error) {
+	tlsConfig, err := loadTLSConfig(opt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certifications: %w", err)
+	}
+	proxy, err := netOpt.proxy()
+	if err != nil {
+		return nil, err
+	}
+	maxConns := netOpt.MaxConnsPerHost
+	if maxConns == 0 {
+		maxConns = defaultMaxConnsPerHost
+	}
+	dialTimeout := netOpt.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
 	}
 	transport := &http.Transport{
+		Proxy: proxy,
 		DialContext: (&net.Dialer{
-			Timeout:       30 * time.Second,
+			Timeout:       dialTimeout,
 			KeepAlive:     30 * time.Second,
 			FallbackDelay: 300 * time.Millisecond,
 		}).DialContext,
-		MaxConnsPerHost:       32, // max http concurrency
-		MaxIdleConns:          32,
+		MaxConnsPerHost:       maxConns, // max http concurrency
+		MaxIdleConns:          maxConns,
+		MaxIdleConnsPerHost:   maxConns,
 		IdleConnTimeout:       30 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		TLSClientConfig:       tlsConfig,
 		ExpectContinueTimeout: 5 * time.Second,
+		ResponseHeaderTimeout: netOpt.ResponseHeaderTimeout,
 	}
-	client := &http.Client{Transport: transport}
-	resolver := docker.NewResolver(docker.ResolverOptions{
-		Hosts: docker.ConfigureDefaultRegistries(
-			docker.WithAuthorizer(docker.NewDockerAuthorizer(
-				docker.WithAuthClient(client),
-				docker.WithAuthHeader(make(http.Header)),
-				docker.WithAuthCreds(func(s string) (string, string, error) {
-					if i := strings.IndexByte(opt.Auth, ':'); i > 0 {
-						return opt.Auth[0:i], opt.Auth[i+1:], nil
-					}
-					return "", "", nil
-				}),
-			)),
-			docker.WithClient(client),
-			docker.WithPlainHTTP(func(s string) (bool, error) {
-				if opt.PlainHTTP {
-					return docker.MatchAllHosts(s)
-				} else {
-					return false, nil
-				}
-			}),
-		),
-	})
+	return &http.Client{Transport: transport}, nil
+}
 
-	return (&graphBuilder{
-		Resolver:       resolver,
-		BuilderOptions: opt,
-	}).Build(ctx)
+// refHost returns the registry host of ref
+func refHost(ref string) (string, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %q: %w", ref, err)
+	}
+	return refspec.Hostname(), nil
 }
 
 type overlaybdBuilder struct {
 	layers int
-	engine builderEngine
+	engine Engine
+
+	// progress reports the stage of layer idx, nil means disabled
+	progress func(ctx context.Context, idx int, stage LayerStage)
+}
+
+func (b *overlaybdBuilder) report(ctx context.Context, idx int, stage LayerStage) {
+	if b.progress != nil {
+		b.progress(ctx, idx, stage)
+	}
 }
 
 // Build return a descriptor of the converted target, as the caller may need it
@@ -362,7 +696,7 @@ func (b *overlaybdBuilder) Build(ctx context.Context) (v1.Descriptor, error) {
 	// check if manifest conversion result is already present in registry, if so, we can avoid conversion.
 	// when errors are encountered fallback to regular conversion
 	if convertedDesc, err := b.engine.CheckForConvertedManifest(ctx); err == nil && convertedDesc.Digest != "" {
-		logrus.Infof("Image found already converted in registry with digest %s", convertedDesc.Digest)
+		log.G(ctx).Infof("Image found already converted in registry with digest %s", convertedDesc.Digest)
 		return convertedDesc, nil
 	}
 
@@ -406,17 +740,19 @@ func (b *overlaybdBuilder) Build(ctx context.Context) (v1.Descriptor, error) {
 				// download the converted layer
 				err := b.engine.DownloadConvertedLayer(rctx, idx, *cachedLayer)
 				if err == nil {
-					logrus.Infof("downloaded cached layer %d", idx)
+					log.G(ctx).Infof("downloaded cached layer %d", idx)
+					b.report(rctx, idx, LayerReused)
 					sendToChannel(rctx, downloaded[idx], nil)
 					return nil
 				}
-				logrus.Infof("failed to download cached layer %d falling back to conversion : %s", idx, err)
+				log.G(ctx).Infof("failed to download cached layer %d falling back to conversion : %s", idx, err)
 			}
 
 			if err := b.engine.DownloadLayer(rctx, idx); err != nil {
 				return err
 			}
-			logrus.Infof("downloaded layer %d", idx)
+			log.G(ctx).Infof("downloaded layer %d", idx)
+			b.report(rctx, idx, LayerDownloaded)
 			sendToChannel(rctx, downloaded[idx], nil)
 			return nil
 		})
@@ -435,7 +771,8 @@ func (b *overlaybdBuilder) Build(ctx context.Context) (v1.Descriptor, error) {
 			if err := b.engine.BuildLayer(rctx, idx); err != nil {
 				return fmt.Errorf("failed to convert layer %d: %w", idx, err)
 			}
-			logrus.Infof("layer %d converted", idx)
+			log.G(ctx).Infof("layer %d converted", idx)
+			b.report(rctx, idx, LayerConverted)
 			// send to upload(idx) and convert(idx+1) once each
 			sendToChannel(rctx, converted[idx], nil)
 			if idx+1 < b.layers {
@@ -452,7 +789,8 @@ func (b *overlaybdBuilder) Build(ctx context.Context) (v1.Descriptor, error) {
 				return fmt.Errorf("failed to upload layer %d: %w", idx, err)
 			}
 			b.engine.StoreConvertedLayerDetails(rctx, idx)
-			logrus.Infof("layer %d uploaded", idx)
+			log.G(ctx).Infof("layer %d uploaded", idx)
+			b.report(rctx, idx, LayerUploaded)
 			return nil
 		})
 	}
@@ -465,7 +803,7 @@ func (b *overlaybdBuilder) Build(ctx context.Context) (v1.Descriptor, error) {
 		return v1.Descriptor{}, errors.Wrap(err, "failed to upload manifest or config")
 	}
 	b.engine.StoreConvertedManifestDetails(ctx)
-	logrus.Info("convert finished")
+	log.G(ctx).Info("convert finished")
 	return targetDesc, nil
 }
 
@@ -0,0 +1,468 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/containerd/accelerated-container-image/pkg/builder/cache"
+	"github.com/containerd/accelerated-container-image/pkg/database"
+	"github.com/containerd/accelerated-container-image/pkg/label"
+	"github.com/containerd/accelerated-container-image/pkg/version"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/continuity"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// BuilderEngineType selects the output format of the conversion. Engines other
+// than the builtin ones can be added by RegisterEngine.
+type BuilderEngineType int
+
+const (
+	Overlaybd BuilderEngineType = iota
+	TurboOCI
+)
+
+const (
+	ArtifactTypeOverlaybd = "application/vnd.containerd.overlaybd.native.v1+json"
+	ArtifactTypeTurboOCI  = "application/vnd.containerd.overlaybd.turbo.v1+json"
+)
+
+const (
+	// acceleration layer archive (tar)
+	accelLayerTar = "accel_layer.tar"
+
+	// name of the trace file inside the acceleration layer
+	accelLayerTraceFile = "trace"
+)
+
+// ArtifactType is set to the converted manifests and indexes when pushing
+// them with subject, see BuilderOptions.Referrer
+func (engine BuilderEngineType) ArtifactType() string {
+	if r, ok := lookupEngine(engine); ok {
+		return r.artifactType
+	}
+	return ""
+}
+
+func (engine BuilderEngineType) String() string {
+	if r, ok := lookupEngine(engine); ok {
+		return r.name
+	}
+	return fmt.Sprintf("BuilderEngineType(%d)", int(engine))
+}
+
+// EngineOptions is what an Engine needs to convert an image manifest
+type EngineOptions struct {
+	BuilderOptions
+
+	// Resolver, Fetcher of the source image and Pusher of the target image
+	Resolver remotes.Resolver
+	Fetcher  remotes.Fetcher
+	Pusher   remotes.Pusher
+
+	// Source is the descriptor of the source manifest
+	Source   specs.Descriptor
+	Manifest specs.Manifest
+	Config   specs.Image
+
+	// WorkDir is dedicated to the manifest, it's expected to be removed by
+	// Engine.Cleanup unless BuilderOptions.Reserve is set
+	WorkDir string
+
+	// Host and Repository of the source image, as the key of BuilderOptions.DB
+	Host       string
+	Repository string
+}
+
+// EngineFactory creates an Engine converting a single image manifest
+type EngineFactory func(ctx context.Context, opt EngineOptions) (Engine, error)
+
+type engineRegistration struct {
+	name         string
+	artifactType string
+	factory      func(ctx context.Context, base *builderEngineBase, opt *BuilderOptions) (Engine, error)
+}
+
+var (
+	enginesMu sync.RWMutex
+	engines   = map[BuilderEngineType]engineRegistration{}
+)
+
+func init() {
+	registerEngine(Overlaybd, engineRegistration{
+		name:         "overlaybd",
+		artifactType: ArtifactTypeOverlaybd,
+		factory: func(ctx context.Context, base *builderEngineBase, opt *BuilderOptions) (Engine, error) {
+			engine := NewOverlayBDBuilderEngine(base).(*overlaybdBuilderEngine)
+			engine.disableSparse = opt.DisableSparse
+			engine.zfileAlgorithm = opt.ZFileAlgorithm
+			engine.zfileBlockSize = opt.ZFileBlockSize
+			return engine, nil
+		},
+	})
+	registerEngine(TurboOCI, engineRegistration{
+		name:         "turboOCI",
+		artifactType: ArtifactTypeTurboOCI,
+		factory: func(ctx context.Context, base *builderEngineBase, opt *BuilderOptions) (Engine, error) {
+			return NewTurboOCIBuilderEngine(base), nil
+		},
+	})
+}
+
+// RegisterEngine adds an engine of output format named name, selected by
+// BuilderOptions.Engine. artifactType is set to the converted manifests when
+// pushing them with subject. Like other registration hooks, it is meant to be
+// called from init(), and panics if engine is already registered.
+//
+// The acceleration layer, the local cache and the layer leases are only
+// supported by the builtin engines.
+func RegisterEngine(engine BuilderEngineType, name, artifactType string, factory EngineFactory) {
+	if factory == nil {
+		panic("builder: RegisterEngine factory is nil")
+	}
+	registerEngine(engine, engineRegistration{
+		name:         name,
+		artifactType: artifactType,
+		factory: func(ctx context.Context, base *builderEngineBase, opt *BuilderOptions) (Engine, error) {
+			return factory(ctx, EngineOptions{
+				BuilderOptions: *opt,
+				Resolver:       base.resolver,
+				Fetcher:        base.fetcher,
+				Pusher:         base.pusher,
+				Source:         base.inputDesc,
+				Manifest:       base.manifest,
+				Config:         base.config,
+				WorkDir:        base.workDir,
+				Host:           base.host,
+				Repository:     base.repository,
+			})
+		},
+	})
+}
+
+func registerEngine(engine BuilderEngineType, r engineRegistration) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	if _, dup := engines[engine]; dup {
+		panic(fmt.Sprintf("builder: engine %d registered twice", int(engine)))
+	}
+	engines[engine] = r
+}
+
+func lookupEngine(engine BuilderEngineType) (engineRegistration, bool) {
+	enginesMu.RLock()
+	defer enginesMu.RUnlock()
+	r, ok := engines[engine]
+	return r, ok
+}
+
+// Engine converts the layers of a single image manifest into a new format.
+// The builder calls it concurrently for different layers, in the order of
+// CheckForConvertedLayer, DownloadLayer or DownloadConvertedLayer, BuildLayer,
+// UploadLayer and StoreConvertedLayerDetails. BuildLayer is called in the
+// order of the layers.
+type Engine interface {
+	DownloadLayer(ctx context.Context, idx int) error
+
+	// build layer archive, maybe tgz or zfile
+	BuildLayer(ctx context.Context, idx int) error
+
+	UploadLayer(ctx context.Context, idx int) error
+
+	// UploadImage upload new manifest and config, return the descriptor of the manifest
+	UploadImage(ctx context.Context) (specs.Descriptor, error)
+
+	// Cleanup removes workdir
+	Cleanup()
+
+	Deduplicateable
+}
+
+// Deduplicateable provides a number of functions to avoid duplicating work when converting images
+// It is used by the Engine to avoid re-converting layers and manifests
+type Deduplicateable interface {
+	// deduplication functions
+	// finds already converted layer in db and validates presence in registry
+	CheckForConvertedLayer(ctx context.Context, idx int) (specs.Descriptor, error)
+
+	// downloads the already converted layer
+	DownloadConvertedLayer(ctx context.Context, idx int, desc specs.Descriptor) error
+
+	// store chainID -> converted layer mapping for layer deduplication
+	StoreConvertedLayerDetails(ctx context.Context, idx int) error
+
+	// store manifest digest -> converted manifest to avoid re-conversion
+	CheckForConvertedManifest(ctx context.Context) (specs.Descriptor, error)
+
+	// store manifest digest -> converted manifest to avoid re-conversion
+	StoreConvertedManifestDetails(ctx context.Context) error
+}
+
+// NoDeduplication can be embedded in an Engine not supporting deduplication,
+// every layer and manifest is converted.
+type NoDeduplication struct{}
+
+func (NoDeduplication) CheckForConvertedLayer(ctx context.Context, idx int) (specs.Descriptor, error) {
+	return specs.Descriptor{}, errdefs.ErrNotFound
+}
+
+func (NoDeduplication) DownloadConvertedLayer(ctx context.Context, idx int, desc specs.Descriptor) error {
+	return errdefs.ErrNotImplemented
+}
+
+func (NoDeduplication) StoreConvertedLayerDetails(ctx context.Context, idx int) error {
+	return nil
+}
+
+func (NoDeduplication) CheckForConvertedManifest(ctx context.Context) (specs.Descriptor, error) {
+	return specs.Descriptor{}, errdefs.ErrNotFound
+}
+
+func (NoDeduplication) StoreConvertedManifestDetails(ctx context.Context) error {
+	return nil
+}
+
+type builderEngineBase struct {
+	resolver     remotes.Resolver
+	fetcher      remotes.Fetcher
+	pusher       remotes.Pusher
+	manifest     specs.Manifest
+	config       specs.Image
+	workDir      string
+	oci          bool
+	fstype       string
+	mkfs         bool
+	vsize        int
+	db           database.ConversionDatabase
+	host         string
+	repository   string
+	inputDesc    specs.Descriptor // original manifest descriptor
+	outputDesc   specs.Descriptor // converted manifest descriptor
+	reserve      bool
+	noUpload     bool
+	dumpManifest bool
+	referrer     bool
+
+	// dryRun only looks up converted manifests and layers, nothing is
+	// mounted, pushed or written to db
+	dryRun bool
+
+	// accelLayerFile is a trace file or priority list to be packed into an
+	// acceleration layer on top of the converted image, empty means none
+	accelLayerFile string
+
+	// cache of converted layer files on local disk, nil means disabled
+	cache *cache.Cache
+
+	// leases of layers being converted, set along with db
+	leases *database.LayerLeases
+}
+
+// layerChainIDs returns the chainID of every layer of the source image
+func (e *builderEngineBase) layerChainIDs() []string {
+	chainIDs := make([]string, len(e.manifest.Layers))
+	var chain []digest.Digest
+	for i := range e.manifest.Layers {
+		chain = append(chain, e.config.RootFS.DiffIDs[i])
+		chainIDs[i] = identity.ChainID(chain).String()
+	}
+	return chainIDs
+}
+
+// layerCompression detects the compression of a source layer from its content.
+// zstd:chunked layers are zstd streams with skippable frames and are reported
+// as zstd.
+func (e *builderEngineBase) layerCompression(ctx context.Context, idx int) (compression.Compression, error) {
+	rc, err := e.fetcher.Fetch(ctx, e.manifest.Layers[idx])
+	if err != nil {
+		return compression.Uncompressed, errors.Wrapf(err, "layerCompression: failed to open layer %d", idx)
+	}
+	defer rc.Close()
+	drc, err := compression.DecompressStream(rc)
+	if err != nil {
+		return compression.Uncompressed, errors.Wrapf(err, "layerCompression: failed to open decompress stream for layer %d", idx)
+	}
+	defer drc.Close()
+	compress := drc.GetCompression()
+	switch compress {
+	case compression.Uncompressed, compression.Gzip, compression.Zstd:
+		return compress, nil
+	default:
+		return compression.Uncompressed, fmt.Errorf("layerCompression: unsupported layer format with compression %s", compress.Extension())
+	}
+}
+
+func (e *builderEngineBase) mediaTypeManifest() string {
+	if e.oci {
+		return specs.MediaTypeImageManifest
+	} else {
+		return images.MediaTypeDockerSchema2Manifest
+	}
+}
+
+func (e *builderEngineBase) mediaTypeConfig() string {
+	if e.oci {
+		return specs.MediaTypeImageConfig
+	} else {
+		return images.MediaTypeDockerSchema2Config
+	}
+}
+
+func (e *builderEngineBase) mediaTypeImageLayerGzip() string {
+	if e.oci {
+		return specs.MediaTypeImageLayerGzip
+	} else {
+		return images.MediaTypeDockerSchema2LayerGzip
+	}
+}
+
+func (e *builderEngineBase) mediaTypeImageLayer() string {
+	if e.oci {
+		return specs.MediaTypeImageLayer
+	} else {
+		return images.MediaTypeDockerSchema2Layer
+	}
+}
+
+func (e *builderEngineBase) uploadManifestAndConfig(ctx context.Context) (specs.Descriptor, error) {
+	cbuf, err := json.Marshal(e.config)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	e.manifest.Config = specs.Descriptor{
+		MediaType: e.mediaTypeConfig(),
+		Digest:    digest.FromBytes(cbuf),
+		Size:      (int64)(len(cbuf)),
+	}
+	if !e.noUpload {
+		if err = uploadBytes(ctx, e.pusher, e.manifest.Config, cbuf); err != nil {
+			return specs.Descriptor{}, errors.Wrapf(err, "failed to upload config")
+		}
+		log.G(ctx).Infof("config uploaded")
+	}
+	if e.dumpManifest {
+		confPath := path.Join(e.workDir, "config.json")
+		if err := continuity.AtomicWriteFile(confPath, cbuf, 0644); err != nil {
+			return specs.Descriptor{}, err
+		}
+		log.G(ctx).Infof("config dumped")
+	}
+
+	e.manifest.MediaType = e.mediaTypeManifest()
+	cbuf, err = json.Marshal(e.manifest)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	manifestDesc := specs.Descriptor{
+		MediaType: e.mediaTypeManifest(),
+		Digest:    digest.FromBytes(cbuf),
+		Size:      (int64)(len(cbuf)),
+	}
+	if !e.noUpload {
+		if err = uploadBytes(ctx, e.pusher, manifestDesc, cbuf); err != nil {
+			return specs.Descriptor{}, errors.Wrapf(err, "failed to upload manifest")
+		}
+		e.outputDesc = manifestDesc
+		log.G(ctx).Infof("manifest uploaded, %s", manifestDesc.Digest)
+	}
+	if e.dumpManifest {
+		descPath := path.Join(e.workDir, "manifest.json")
+		if err := continuity.AtomicWriteFile(descPath, cbuf, 0644); err != nil {
+			return specs.Descriptor{}, err
+		}
+		log.G(ctx).Infof("manifest dumped")
+	}
+	return manifestDesc, nil
+}
+
+// appendAccelerationLayer packs accelLayerFile into an acceleration layer, uploads
+// it and appends it on top of the converted manifest and config. It must be called
+// after the converted layers are in place.
+func (e *builderEngineBase) appendAccelerationLayer(ctx context.Context) error {
+	if e.accelLayerFile == "" {
+		return nil
+	}
+	tarFile := path.Join(e.workDir, accelLayerTar)
+	desc, err := buildAccelerationLayer(ctx, e.accelLayerFile, tarFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to build acceleration layer")
+	}
+	desc.MediaType = e.mediaTypeImageLayer()
+	desc.Annotations = map[string]string{
+		label.OverlayBDVersion:    version.OverlayBDVersionNumber,
+		label.OverlayBDBlobDigest: desc.Digest.String(),
+		label.OverlayBDBlobSize:   fmt.Sprintf("%d", desc.Size),
+		label.AccelerationLayer:   "yes",
+	}
+	// same as record-trace, inherit the fs type from the top layer
+	if n := len(e.manifest.Layers); n > 0 {
+		if fsType := e.manifest.Layers[n-1].Annotations[label.OverlayBDBlobFsType]; fsType != "" {
+			desc.Annotations[label.OverlayBDBlobFsType] = fsType
+		}
+	}
+	if !e.noUpload {
+		if err := uploadBlob(ctx, e.pusher, tarFile, desc); err != nil {
+			return errors.Wrapf(err, "failed to upload acceleration layer")
+		}
+		log.G(ctx).Infof("acceleration layer uploaded")
+	}
+	e.manifest.Layers = append(e.manifest.Layers, desc)
+	e.config.RootFS.DiffIDs = append(e.config.RootFS.DiffIDs, desc.Digest)
+	e.config.History = append(e.config.History, specs.History{
+		CreatedBy: "Acceleration Layer",
+	})
+	return nil
+}
+
+func getBuilderEngineBase(ctx context.Context, resolver remotes.Resolver, ref, targetRef string) (*builderEngineBase, error) {
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve reference %q", ref)
+	}
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get fetcher for %q", ref)
+	}
+	pusher, err := resolver.Pusher(ctx, targetRef)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get pusher for %q", targetRef)
+	}
+	manifest, config, err := fetchManifestAndConfig(ctx, fetcher, desc)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch manifest and config")
+	}
+	return &builderEngineBase{
+		resolver:  resolver,
+		fetcher:   fetcher,
+		pusher:    pusher,
+		manifest:  *manifest,
+		config:    *config,
+		inputDesc: desc,
+	}, nil
+}
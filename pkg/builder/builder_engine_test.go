@@ -0,0 +1,239 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testingresources "github.com/containerd/accelerated-container-image/pkg/builder/testingresources"
+	obdconv "github.com/containerd/accelerated-container-image/pkg/convertor"
+	"github.com/containerd/accelerated-container-image/pkg/label"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	_ "github.com/containerd/containerd/v2/pkg/testutil" // Handle custom root flag
+	"github.com/containerd/containerd/v2/plugins/content/local"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func Test_builderEngineBase_layerCompression(t *testing.T) {
+	ctx := context.Background()
+	reg := testingresources.GetTestRegistry(t, ctx, testingresources.RegistryOptions{})
+	for repo, compress := range map[string]compression.Compression{
+		"hello-world-zstd": compression.Zstd,
+		"hello-world-tar":  compression.Uncompressed,
+	} {
+		if err := reg.Recompress(ctx, "hello-world", repo, "amd64", compress); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolver := testingresources.GetCustomTestResolver(t, ctx, reg)
+
+	type fields struct {
+		fetcher  remotes.Fetcher
+		manifest specs.Manifest
+	}
+	getFields := func(ctx context.Context, ref string) fields {
+		_, desc, err := resolver.Resolve(ctx, ref)
+		if err != nil {
+			t.Error(err)
+		}
+
+		fetcher, err := resolver.Fetcher(ctx, ref)
+		if err != nil {
+			t.Error(err)
+		}
+
+		manifestStream, err := fetcher.Fetch(ctx, desc)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		parsedManifest := specs.Manifest{}
+		decoder := json.NewDecoder(manifestStream)
+		if err = decoder.Decode(&parsedManifest); err != nil {
+			t.Error(err)
+		}
+
+		return fields{
+			fetcher:  fetcher,
+			manifest: parsedManifest,
+		}
+	}
+
+	type args struct {
+		ctx context.Context
+		idx int
+	}
+	tests := []struct {
+		name    string
+		fields  fields
+		args    args
+		want    compression.Compression
+		wantErr bool
+	}{
+		{
+			name:   "Valid Gzip Layer",
+			fields: getFields(ctx, testingresources.DockerV2_Manifest_Simple_Ref),
+			args: args{
+				ctx: ctx,
+				idx: 0,
+			},
+			want:    compression.Gzip,
+			wantErr: false,
+		},
+		{
+			name:   "Valid Zstd Layer",
+			fields: getFields(ctx, "sample.localstore.io/hello-world-zstd:amd64"),
+			args: args{
+				ctx: ctx,
+				idx: 0,
+			},
+			want:    compression.Zstd,
+			wantErr: false,
+		},
+		{
+			name:   "Valid Uncompressed Layer",
+			fields: getFields(ctx, "sample.localstore.io/hello-world-tar:amd64"),
+			args: args{
+				ctx: ctx,
+				idx: 0,
+			},
+			want:    compression.Uncompressed,
+			wantErr: false,
+		},
+		{
+			name: "Layer Not Found",
+			fields: func() fields {
+				fields := getFields(ctx, testingresources.DockerV2_Manifest_Simple_Ref)
+				fields.manifest.Layers[0].Digest = digest.FromString("sample")
+				return fields
+			}(),
+			args: args{
+				ctx: ctx,
+				idx: 0,
+			},
+			want:    compression.Uncompressed,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &builderEngineBase{
+				fetcher:  tt.fields.fetcher,
+				manifest: tt.fields.manifest,
+			}
+			got, err := e.layerCompression(tt.args.ctx, tt.args.idx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("builderEngineBase.layerCompression() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("builderEngineBase.layerCompression() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getBuilderEngineBase(t *testing.T) {
+	resolver := testingresources.GetTestResolver(t, context.Background())
+	engine, err := getBuilderEngineBase(context.TODO(),
+		resolver,
+		testingresources.DockerV2_Manifest_Simple_Ref,
+		fmt.Sprintf("%s-obd", testingresources.DockerV2_Manifest_Simple_Ref),
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	testingresources.Assert(t, engine.fetcher != nil, "Fetcher is nil")
+	testingresources.Assert(t, engine.pusher != nil, "Pusher is nil")
+	testingresources.Assert(t,
+		engine.manifest.Config.Digest == testingresources.DockerV2_Manifest_Simple_Config_Digest,
+		fmt.Sprintf("Config Digest is not equal to %s", testingresources.DockerV2_Manifest_Simple_Config_Digest))
+
+	content, err := testingresources.ConsistentManifestMarshal(&engine.manifest)
+	if err != nil {
+		t.Errorf("Could not parse obtained manifest, got: %v", err)
+	}
+
+	testingresources.Assert(t,
+		digest.FromBytes(content) == testingresources.DockerV2_Manifest_Simple_Digest,
+		fmt.Sprintf("Manifest Digest is not equal to %s", testingresources.DockerV2_Manifest_Simple_Digest))
+}
+
+func Test_uploadManifestAndConfig(t *testing.T) {
+}
+
+func Test_builderEngineBase_appendAccelerationLayer(t *testing.T) {
+	ctx := context.Background()
+	testingresources.RunTestWithTempDir(t, ctx, "accelerationLayerMatchesRecordTrace", func(t *testing.T, ctx context.Context, workdir string) {
+		traceFile := filepath.Join(workdir, "priority_list")
+		if err := os.WriteFile(traceFile, []byte("/usr/bin/containerd\n/usr/bin/nerdctl\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// reference layer, as built by `ctr record-trace`
+		cs, err := local.NewStore(filepath.Join(workdir, "content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		loader := obdconv.NewContentLoaderWithFsType(true, "", obdconv.ContentFile{SrcFilePath: traceFile, DstFileName: "trace"})
+		expected, err := loader.Load(ctx, cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := &builderEngineBase{
+			workDir:        workdir,
+			oci:            true,
+			noUpload:       true,
+			accelLayerFile: traceFile,
+			manifest: specs.Manifest{
+				Layers: []specs.Descriptor{{Digest: digest.FromString("layer")}},
+			},
+			config: specs.Image{
+				RootFS: specs.RootFS{DiffIDs: []digest.Digest{digest.FromString("layer")}},
+			},
+		}
+		if err := e.appendAccelerationLayer(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		testingresources.Assert(t, len(e.manifest.Layers) == 2, "acceleration layer was not appended to manifest")
+		testingresources.Assert(t, len(e.config.RootFS.DiffIDs) == 2, "acceleration layer was not appended to diffIDs")
+		got := e.manifest.Layers[1]
+		testingresources.Assert(t, got.Digest == expected.Desc.Digest,
+			fmt.Sprintf("acceleration layer digest %s, expected %s", got.Digest, expected.Desc.Digest))
+		testingresources.Assert(t, got.Size == expected.Desc.Size,
+			fmt.Sprintf("acceleration layer size %d, expected %d", got.Size, expected.Desc.Size))
+		testingresources.Assert(t, e.config.RootFS.DiffIDs[1] == expected.DiffID, "acceleration layer diffID mismatch")
+		for _, key := range []string{label.OverlayBDVersion, label.OverlayBDBlobDigest, label.OverlayBDBlobSize, label.AccelerationLayer} {
+			testingresources.Assert(t, got.Annotations[key] == expected.Desc.Annotations[key],
+				fmt.Sprintf("annotation %s is %q, expected %q", key, got.Annotations[key], expected.Desc.Annotations[key]))
+		}
+	})
+}
@@ -0,0 +1,544 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/accelerated-container-image/pkg/builder/testingresources"
+	"github.com/containerd/accelerated-container-image/pkg/label"
+	"github.com/containerd/accelerated-container-image/pkg/utils/faketools"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	_ "github.com/containerd/containerd/v2/pkg/testutil" // Handle custom root flag
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMain(m *testing.M) {
+	faketools.Main()
+	os.Exit(m.Run())
+}
+
+// Test_builder_Err_Fuzz_Build This test is for the arguably complex error handling and potential go routine
+// locking that can happen for the builder component. It works by testing multiple potential error patterns
+// across all stages of the process (Through consistent pseudo random generation, for reproducibility and
+// ease of adjustment). The test is designed to run in parallel to maximize the chance of a contention.
+func Test_builder_Build_Contention(t *testing.T) {
+	// If timeout of 1 second is exceeded with the mock fuz builder engine
+	// then there is a high likelihood of a present contention error
+	contentionTimeout := time.Second * 1
+	patternCount := int64(500) // Try out 500 different seeds
+
+	var i int64
+	for i = 0; i < patternCount; i++ {
+		seed := i
+		t.Run(fmt.Sprintf("Test_builder_Err_Lock Contention Seed %d", i), func(t *testing.T) {
+			t.Parallel()
+			fixedRand := rand.New(rand.NewSource(seed))
+			Engine := newMockBuilderEngine(fixedRand)
+			b := &overlaybdBuilder{
+				engine: Engine,
+				layers: 25,
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), contentionTimeout)
+			defer cancel()
+
+			b.Build(ctx)
+			// Build will typically return an error but completes successfully for some seeds as well
+			if ctx.Err() != nil {
+				if ctx.Err() == context.DeadlineExceeded {
+					t.Errorf("Context deadline was exceeded, likely contention error")
+				}
+			}
+		})
+	}
+}
+
+const (
+	failRate = 0.05 // 5% of the time, fail any given operation
+)
+
+type mockFuzzBuilderEngine struct {
+	fixedRand *rand.Rand
+}
+
+func newMockBuilderEngine(fixedRand *rand.Rand) Engine {
+	return &mockFuzzBuilderEngine{
+		fixedRand: fixedRand,
+	}
+}
+
+func (e *mockFuzzBuilderEngine) DownloadLayer(ctx context.Context, idx int) error {
+	if e.fixedRand.Float64() < failRate {
+		return fmt.Errorf("random error on download")
+	}
+	return nil
+}
+
+func (e *mockFuzzBuilderEngine) BuildLayer(ctx context.Context, idx int) error {
+	if e.fixedRand.Float64() < failRate {
+		return fmt.Errorf("random error on BuildLayer")
+	}
+	return nil
+}
+
+func (e *mockFuzzBuilderEngine) UploadLayer(ctx context.Context, idx int) error {
+	if e.fixedRand.Float64() < failRate {
+		return fmt.Errorf("random error on UploadLayer")
+	}
+	return nil
+}
+
+func (e *mockFuzzBuilderEngine) UploadImage(ctx context.Context) (specs.Descriptor, error) {
+	if e.fixedRand.Float64() < failRate {
+		return specs.Descriptor{}, fmt.Errorf("random error on UploadImage")
+	}
+	return specs.Descriptor{}, nil
+}
+
+func (e *mockFuzzBuilderEngine) CheckForConvertedLayer(ctx context.Context, idx int) (specs.Descriptor, error) {
+	if e.fixedRand.Float64() < failRate {
+		return specs.Descriptor{}, fmt.Errorf("random error on CheckForConvertedLayer")
+	}
+	return specs.Descriptor{}, nil
+}
+
+func (e *mockFuzzBuilderEngine) StoreConvertedLayerDetails(ctx context.Context, idx int) error {
+	if e.fixedRand.Float64() < failRate {
+		return fmt.Errorf("random error on StoreConvertedLayerDetails")
+	}
+	return nil
+}
+
+func (e *mockFuzzBuilderEngine) CheckForConvertedManifest(ctx context.Context) (specs.Descriptor, error) {
+	if e.fixedRand.Float64() < failRate {
+		return specs.Descriptor{}, fmt.Errorf("random error on CheckForConvertedManifest")
+	}
+	return specs.Descriptor{}, nil
+}
+
+func (e *mockFuzzBuilderEngine) StoreConvertedManifestDetails(ctx context.Context) error {
+	if e.fixedRand.Float64() < failRate {
+		return fmt.Errorf("random error on StoreConvertedManifestDetails")
+	}
+	return nil
+}
+
+func (e *mockFuzzBuilderEngine) DownloadConvertedLayer(ctx context.Context, idx int, desc specs.Descriptor) error {
+	if e.fixedRand.Float64() < failRate {
+		return fmt.Errorf("random error on DownloadConvertedLayer")
+	}
+	return nil
+}
+
+func (e *mockFuzzBuilderEngine) Cleanup() {
+}
+
+const fakeEngineType BuilderEngineType = 1000
+
+func init() {
+	RegisterEngine(fakeEngineType, "fake", "application/vnd.example.fake", func(ctx context.Context, opt EngineOptions) (Engine, error) {
+		return &fakeEngine{opt: opt}, nil
+	})
+}
+
+// fakeEngine is a registered engine converting nothing
+type fakeEngine struct {
+	NoDeduplication
+	opt EngineOptions
+}
+
+func (e *fakeEngine) DownloadLayer(ctx context.Context, idx int) error {
+	return nil
+}
+
+func (e *fakeEngine) BuildLayer(ctx context.Context, idx int) error {
+	return nil
+}
+
+func (e *fakeEngine) UploadLayer(ctx context.Context, idx int) error {
+	return nil
+}
+
+func (e *fakeEngine) UploadImage(ctx context.Context) (specs.Descriptor, error) {
+	return specs.Descriptor{
+		MediaType: e.opt.Source.MediaType,
+		Digest:    digest.FromString(e.opt.Host + "/" + e.opt.Repository),
+	}, nil
+}
+
+func (e *fakeEngine) Cleanup() {
+}
+
+func Test_builder_RegisteredEngine(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu        sync.Mutex
+		stages    = map[LayerStage]int{}
+		completed []specs.Descriptor
+	)
+	b, err := NewBuilder(BuilderOptions{
+		Ref:       testingresources.DockerV2_Manifest_Simple_Ref,
+		TargetRef: "sample.localstore.io/hello-world:fake",
+		WorkDir:   t.TempDir(),
+		Engine:    fakeEngineType,
+		Resolver:  testingresources.GetTestResolver(t, ctx),
+		OnLayerProgress: func(ctx context.Context, p LayerProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			stages[p.Stage]++
+		},
+		OnComplete: func(ctx context.Context, src, target specs.Descriptor, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				t.Errorf("OnComplete() got error: %v", err)
+			}
+			completed = append(completed, target)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	testingresources.Assert(t, fakeEngineType.String() == "fake", "String() of registered engine is incorrect")
+	testingresources.Assert(t, len(completed) == 1, fmt.Sprintf("OnComplete() called %d times, expected 1", len(completed)))
+	testingresources.Assert(t, completed[0].Digest == digest.FromString("sample.localstore.io/hello-world"), "OnComplete() got incorrect target")
+	for _, stage := range []LayerStage{LayerDownloaded, LayerConverted, LayerUploaded} {
+		testingresources.Assert(t, stages[stage] == 1, fmt.Sprintf("OnLayerProgress() reported %v %d times, expected 1", stage, stages[stage]))
+	}
+
+	_, err = NewBuilder(BuilderOptions{Engine: fakeEngineType + 1})
+	testingresources.Assert(t, err != nil, "NewBuilder() accepted an unknown engine")
+}
+
+// Test_builder_Build_FakeTools converts the sample image end-to-end, with the
+// overlaybd tools replaced by faketools
+func Test_builder_Build_FakeTools(t *testing.T) {
+	ctx := context.Background()
+	binDir := faketools.Install(t)
+
+	build := func(t *testing.T, engine BuilderEngineType) (remotes.Resolver, specs.Descriptor) {
+		resolver := testingresources.GetTestResolver(t, ctx)
+		var target specs.Descriptor
+		b, err := NewBuilder(BuilderOptions{
+			Ref:             testingresources.DockerV2_Manifest_Simple_Ref,
+			TargetRef:       "sample.localstore.io/hello-world:" + engine.String(),
+			WorkDir:         t.TempDir(),
+			Engine:          engine,
+			Mkfs:            true,
+			Vsize:           64,
+			OCI:             true,
+			Resolver:        resolver,
+			OverlayBDBinDir: binDir,
+			OnComplete: func(ctx context.Context, src, dst specs.Descriptor, err error) {
+				target = dst
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Build(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return resolver, target
+	}
+	fetch := func(t *testing.T, fetcher remotes.Fetcher, desc specs.Descriptor) []byte {
+		rc, err := fetcher.Fetch(ctx, desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	for _, tc := range []struct {
+		engine BuilderEngineType
+		file   string // file of the converted layer tar, empty if the layer is the file itself
+		header string
+	}{
+		{Overlaybd, "", faketools.CommitHeader + " -z -t --uuid"},
+		{TurboOCI, "ext4.fs.meta", faketools.CommitHeader + " -z --fastoci"},
+	} {
+		t.Run(tc.engine.String(), func(t *testing.T) {
+			resolver, target := build(t, tc.engine)
+			_, again := build(t, tc.engine)
+			testingresources.Assert(t, target.Digest != "", "OnComplete() got no target")
+			testingresources.Assert(t, target.Digest == again.Digest, "conversion is not deterministic")
+
+			fetcher := testingresources.GetTestFetcherFromResolver(t, ctx, resolver, "sample.localstore.io/hello-world@"+target.Digest.String())
+			var manifest specs.Manifest
+			if err := json.Unmarshal(fetch(t, fetcher, target), &manifest); err != nil {
+				t.Fatal(err)
+			}
+			testingresources.Assert(t, len(manifest.Layers) == 1, fmt.Sprintf("got %d layers, expected 1", len(manifest.Layers)))
+
+			data := fetch(t, fetcher, manifest.Layers[0])
+			if tc.file != "" {
+				data = readTarFile(t, data, tc.file)
+			}
+			testingresources.Assert(t, strings.HasPrefix(string(data), tc.header), fmt.Sprintf("unexpected converted file: %q", data))
+			testingresources.Assert(t, strings.Contains(string(data), "create vsize=64 mkfs=true\n"), fmt.Sprintf("layer isn't created with mkfs: %q", data))
+		})
+	}
+}
+
+// readTarFile returns the content of name in a tar or tar.gz
+func readTarFile(t *testing.T, data []byte, name string) []byte {
+	r, err := compression.DecompressStream(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == name {
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return content
+		}
+	}
+	t.Fatalf("%s not found", name)
+	return nil
+}
+
+// Test_builder_Build_Zstd converts the sample image with its layer recompressed
+// to zstd. Both engines apply the decompressed tar, and turboOCI refers to an
+// uploaded copy of it since zstd isn't seekable.
+func Test_builder_Build_Zstd(t *testing.T) {
+	ctx := context.Background()
+	binDir := faketools.Install(t)
+
+	for _, engine := range []BuilderEngineType{Overlaybd, TurboOCI} {
+		t.Run(engine.String(), func(t *testing.T) {
+			reg := testingresources.GetTestRegistry(t, ctx, testingresources.RegistryOptions{})
+			if err := reg.Recompress(ctx, "hello-world", "hello-world-zstd", "amd64", compression.Zstd); err != nil {
+				t.Fatal(err)
+			}
+			resolver := testingresources.GetCustomTestResolver(t, ctx, reg)
+			var target specs.Descriptor
+			b, err := NewBuilder(BuilderOptions{
+				Ref:             "sample.localstore.io/hello-world-zstd:amd64",
+				TargetRef:       "sample.localstore.io/hello-world-zstd:" + engine.String(),
+				WorkDir:         t.TempDir(),
+				Engine:          engine,
+				Mkfs:            true,
+				Vsize:           64,
+				OCI:             true,
+				Resolver:        resolver,
+				OverlayBDBinDir: binDir,
+				OnComplete: func(ctx context.Context, src, dst specs.Descriptor, err error) {
+					target = dst
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Build(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			fetch := func(desc specs.Descriptor) []byte {
+				rc, err := reg.Fetch(ctx, "hello-world-zstd", desc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer rc.Close()
+				data, err := io.ReadAll(rc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return data
+			}
+			var manifest specs.Manifest
+			if err := json.Unmarshal(fetch(target), &manifest); err != nil {
+				t.Fatal(err)
+			}
+			rc, err := reg.Fetch(ctx, "hello-world", specs.Descriptor{Digest: testingresources.DockerV2_Manifest_Simple_Layer_0_Digest})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dr, err := compression.DecompressStream(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diffID, err := digest.FromReader(dr)
+			dr.Close()
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			layer := manifest.Layers[0]
+			data := fetch(layer)
+			if engine == TurboOCI {
+				testingresources.Assert(t, layer.Annotations[label.TurboOCIDigest] == diffID.String(), "turboOCI doesn't refer to the decompressed layer")
+				testingresources.Assert(t, layer.Annotations[label.TurboOCIMediaType] == images.MediaTypeDockerSchema2Layer,
+					"unexpected target media type "+layer.Annotations[label.TurboOCIMediaType])
+				testingresources.Assert(t, digest.FromBytes(fetch(specs.Descriptor{Digest: diffID})) == diffID, "decompressed layer isn't uploaded")
+				data = readTarFile(t, data, "ext4.fs.meta")
+			}
+			testingresources.Assert(t, strings.Contains(string(data), " "+diffID.String()+" "), fmt.Sprintf("decompressed layer isn't applied: %q", data))
+		})
+	}
+}
+
+// Test_builder_Build_HTTPRegistry converts the sample image through the docker
+// resolver, against a registry served over HTTP
+func Test_builder_Build_HTTPRegistry(t *testing.T) {
+	ctx := context.Background()
+	binDir := faketools.Install(t)
+
+	newRegistry := func(t *testing.T, tls bool) *testingresources.HTTPRegistry {
+		return testingresources.NewHTTPRegistry(t, ctx, testingresources.HTTPRegistryOptions{
+			Username: "user",
+			Password: "pass",
+			TLS:      tls,
+		})
+	}
+	build := func(reg *testingresources.HTTPRegistry, target string, modify func(opt *BuilderOptions)) (specs.Descriptor, error) {
+		var converted specs.Descriptor
+		opt := BuilderOptions{
+			Ref:             reg.Ref(testingresources.DockerV2_Manifest_Simple_Ref[strings.Index(testingresources.DockerV2_Manifest_Simple_Ref, "/")+1:]),
+			TargetRef:       reg.Ref(target),
+			Auth:            "user:pass",
+			PlainHTTP:       true,
+			WorkDir:         t.TempDir(),
+			Engine:          Overlaybd,
+			Mkfs:            true,
+			Vsize:           64,
+			OverlayBDBinDir: binDir,
+			OnComplete: func(ctx context.Context, src, target specs.Descriptor, err error) {
+				converted = target
+			},
+		}
+		if modify != nil {
+			modify(&opt)
+		}
+		b, err := NewBuilder(opt)
+		if err != nil {
+			return specs.Descriptor{}, err
+		}
+		return converted, b.Build(ctx)
+	}
+	requested := func(reg *testingresources.HTTPRegistry, substr string) bool {
+		for _, req := range reg.Requests() {
+			if strings.Contains(req, substr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("plain http with token auth", func(t *testing.T) {
+		reg := newRegistry(t, false)
+		target, err := build(reg, "hello-world:obd", func(opt *BuilderOptions) {
+			opt.OCI = true
+			opt.Referrer = true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, err := reg.Registry().Resolve(ctx, reg.Ref("hello-world:obd"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testingresources.Assert(t, desc.Digest == target.Digest, "target tag isn't pushed")
+		testingresources.Assert(t, requested(reg, " /token"), "token endpoint isn't used")
+		testingresources.Assert(t, requested(reg, "PUT /v2/hello-world/blobs/uploads/"), "layer isn't uploaded")
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		reg := newRegistry(t, true)
+		_, err := build(reg, "hello-world:obd", func(opt *BuilderOptions) {
+			opt.PlainHTTP = false
+			opt.HTTPClient = reg.Client()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("cross repository mount", func(t *testing.T) {
+		reg := newRegistry(t, false)
+		db := testingresources.NewLocalDB()
+		if _, err := build(reg, "hello-world:obd", func(opt *BuilderOptions) { opt.DB = db }); err != nil {
+			t.Fatal(err)
+		}
+		// the same source image in another repository is converted by mounting the result
+		if err := reg.Registry().Copy(ctx, "hello-world", "mirror/hello-world", "amd64"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := build(reg, "mirror/hello-world:obd", func(opt *BuilderOptions) {
+			opt.DB = db
+			opt.Ref = reg.Ref("mirror/hello-world:amd64")
+		}); err != nil {
+			t.Fatal(err)
+		}
+		testingresources.Assert(t, requested(reg, "POST /v2/mirror/hello-world/blobs/uploads/?mount=sha256:"), "converted layers aren't mounted")
+		_, err := reg.Registry().Resolve(ctx, reg.Ref("mirror/hello-world:obd"))
+		testingresources.Assert(t, err == nil, "mounted image isn't tagged")
+	})
+
+	t.Run("faults", func(t *testing.T) {
+		reg := newRegistry(t, false)
+		layerPath := "/blobs/" + testingresources.DockerV2_Manifest_Simple_Layer_0_Digest
+
+		reg.InjectFault(testingresources.Fault{Method: http.MethodGet, Path: layerPath, Status: http.StatusServiceUnavailable})
+		_, err := build(reg, "hello-world:obd", nil)
+		testingresources.Assert(t, err != nil, "Build() succeeded with the source layer unavailable")
+
+		reg.ClearFaults()
+		reg.InjectFault(testingresources.Fault{Method: http.MethodGet, Path: layerPath, Truncate: true})
+		_, err = build(reg, "hello-world:obd", nil)
+		testingresources.Assert(t, err != nil, "Build() succeeded with a truncated source layer")
+
+		reg.ClearFaults()
+		reg.InjectFault(testingresources.Fault{Latency: 10 * time.Millisecond})
+		if _, err := build(reg, "hello-world:obd", nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
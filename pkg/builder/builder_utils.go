@@ -18,6 +18,7 @@ package builder
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/sha256"
@@ -38,7 +39,6 @@ import (
 	"github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 
 	t "github.com/containerd/accelerated-container-image/pkg/types"
 )
@@ -203,7 +203,7 @@ func uploadBlob(ctx context.Context, pusher remotes.Pusher, path string, desc sp
 	cw, err := pusher.Push(ctx, desc)
 	if err != nil {
 		if errdefs.IsAlreadyExists(err) {
-			logrus.Infof("layer %s exists", desc.Digest.String())
+			log.G(ctx).Infof("layer %s exists", desc.Digest.String())
 			return nil
 		}
 		return err
@@ -225,7 +225,7 @@ func uploadBytes(ctx context.Context, pusher remotes.Pusher, desc specs.Descript
 	cw, err := pusher.Push(ctx, desc)
 	if err != nil {
 		if errdefs.IsAlreadyExists(err) {
-			logrus.Infof("content %s exists", desc.Digest.String())
+			log.G(ctx).Infof("content %s exists", desc.Digest.String())
 			return nil
 		}
 		return err
@@ -255,6 +255,48 @@ func buildArchiveFromFiles(ctx context.Context, target string, compress compress
 	return nil
 }
 
+// buildAccelerationLayer packs the trace (or priority list) file at src into an
+// uncompressed tar at target. The layout matches the acceleration layer built by
+// `ctr record-trace`, so the resulting blob is identical for the same input.
+func buildAccelerationLayer(ctx context.Context, src, target string) (specs.Descriptor, error) {
+	fsrc, err := os.Open(src)
+	if err != nil {
+		return specs.Descriptor{}, errors.Wrapf(err, "failed to open %s", src)
+	}
+	defer fsrc.Close()
+	fstat, err := fsrc.Stat()
+	if err != nil {
+		return specs.Descriptor{}, errors.Wrapf(err, "failed to get info of %s", src)
+	}
+
+	fdes, err := os.Create(target)
+	if err != nil {
+		return specs.Descriptor{}, errors.Wrapf(err, "failed to create file %s", target)
+	}
+	defer fdes.Close()
+	digester := digest.Canonical.Digester()
+	countWriter := &writeCountWrapper{w: io.MultiWriter(fdes, digester.Hash())}
+	tarWriter := tar.NewWriter(countWriter)
+	if err := tarWriter.WriteHeader(&tar.Header{
+		Name:     accelLayerTraceFile,
+		Mode:     0444,
+		Size:     fstat.Size(),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return specs.Descriptor{}, errors.Wrapf(err, "failed to write tar header")
+	}
+	if _, err := io.Copy(tarWriter, bufio.NewReader(fsrc)); err != nil {
+		return specs.Descriptor{}, errors.Wrapf(err, "failed to copy IO")
+	}
+	if err := tarWriter.Close(); err != nil {
+		return specs.Descriptor{}, errors.Wrapf(err, "failed to close tar file")
+	}
+	return specs.Descriptor{
+		Digest: digester.Digest(),
+		Size:   countWriter.c,
+	}, nil
+}
+
 func addFileToArchive(ctx context.Context, ftar *tar.Writer, filepath string) error {
 	file, err := os.Open(filepath)
 	if err != nil {
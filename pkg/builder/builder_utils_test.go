@@ -27,7 +27,7 @@ import (
 	"reflect"
 	"testing"
 
-	testingresources "github.com/containerd/accelerated-container-image/cmd/convertor/testingresources"
+	testingresources "github.com/containerd/accelerated-container-image/pkg/builder/testingresources"
 	sn "github.com/containerd/accelerated-container-image/pkg/types"
 	"github.com/containerd/containerd/v2/core/images"
 	"github.com/containerd/containerd/v2/core/remotes"
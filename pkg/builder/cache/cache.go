@@ -0,0 +1,287 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package cache is a local content-addressed cache of converted layer files,
+// shared by convertor processes on the same host.
+//
+// Entries are keyed by the conversion profile and the chainID of the source
+// layer. The cache directory is laid out as:
+//
+//	<root>/.lock           flock(2), shared for reads, exclusive for updates
+//	<root>/entries/<key>/  files of an entry and index.json, mtime is the last access
+//	<root>/tmp/            entries being stored
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	lockFile   = ".lock"
+	entriesDir = "entries"
+	tmpDir     = "tmp"
+	indexFile  = "index.json"
+)
+
+// File describes a file of a cache entry
+type File struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+}
+
+// Cache is a size limited LRU cache of converted layer files
+type Cache struct {
+	root    string
+	maxSize int64
+}
+
+// New creates a cache in root, maxSize is the limit of the total size of the
+// entries in bytes, 0 means no limit.
+func New(root string, maxSize int64) (*Cache, error) {
+	for _, dir := range []string{entriesDir, tmpDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, errors.Wrapf(err, "failed to create cache dir %s", root)
+		}
+	}
+	return &Cache{
+		root:    root,
+		maxSize: maxSize,
+	}, nil
+}
+
+// Key returns the cache key of a layer converted with profile
+func Key(profile, chainID string) string {
+	h := sha256.Sum256([]byte(profile + "\n" + chainID))
+	return hex.EncodeToString(h[:])
+}
+
+// Lookup returns the files of the entry key, and marks it as recently used
+func (c *Cache) Lookup(ctx context.Context, key string) (map[string]File, bool) {
+	unlock, err := c.lock(unix.LOCK_SH)
+	if err != nil {
+		log.G(ctx).Warnf("cache: failed to lock: %v", err)
+		return nil, false
+	}
+	defer unlock()
+
+	dir := c.entryDir(key)
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil {
+		return nil, false
+	}
+	var files map[string]File
+	if err := json.Unmarshal(data, &files); err != nil {
+		log.G(ctx).Warnf("cache: invalid index of entry %s: %v", key, err)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	return files, true
+}
+
+// Restore copies the files of the entry key into dir, hard links are used
+// when possible.
+func (c *Cache) Restore(ctx context.Context, key, dir string) error {
+	unlock, err := c.lock(unix.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := os.ReadFile(filepath.Join(c.entryDir(key), indexFile))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read cache entry %s", key)
+	}
+	var files map[string]File
+	if err := json.Unmarshal(data, &files); err != nil {
+		return errors.Wrapf(err, "invalid index of cache entry %s", key)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name := range files {
+		if err := linkOrCopy(filepath.Join(c.entryDir(key), name), filepath.Join(dir, name)); err != nil {
+			return errors.Wrapf(err, "failed to restore %s from cache entry %s", name, key)
+		}
+	}
+	return nil
+}
+
+// Store adds files as the entry key, files are copied so the caller keeps
+// ownership. Nothing is done if the entry already exists.
+func (c *Cache) Store(ctx context.Context, key string, files ...string) error {
+	if _, ok := c.Lookup(ctx, key); ok {
+		return nil
+	}
+	tmp, err := os.MkdirTemp(filepath.Join(c.root, tmpDir), key+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	index := make(map[string]File)
+	for _, f := range files {
+		name := filepath.Base(f)
+		desc, err := copyFile(f, filepath.Join(tmp, name))
+		if err != nil {
+			return errors.Wrapf(err, "failed to copy %s into cache", f)
+		}
+		index[name] = desc
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, indexFile), data, 0444); err != nil {
+		return err
+	}
+
+	unlock, err := c.lock(unix.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Rename(tmp, c.entryDir(key)); err != nil {
+		if _, serr := os.Stat(c.entryDir(key)); serr == nil {
+			// stored by another process meanwhile
+			return nil
+		}
+		return errors.Wrapf(err, "failed to store cache entry %s", key)
+	}
+	log.G(ctx).Debugf("cache: entry %s stored", key)
+	return c.evict(ctx)
+}
+
+type entryInfo struct {
+	key   string
+	size  int64
+	atime time.Time
+}
+
+// evict removes the least recently used entries until the total size fits in
+// maxSize. It must be called with the exclusive lock held.
+func (c *Cache) evict(ctx context.Context) error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	dirs, err := os.ReadDir(filepath.Join(c.root, entriesDir))
+	if err != nil {
+		return err
+	}
+	var (
+		entries []entryInfo
+		total   int64
+	)
+	for _, d := range dirs {
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		size := dirSize(filepath.Join(c.root, entriesDir, d.Name()))
+		entries = append(entries, entryInfo{key: d.Name(), size: size, atime: info.ModTime()})
+		total += size
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].atime.Before(entries[j].atime)
+	})
+	for _, e := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.RemoveAll(c.entryDir(e.key)); err != nil {
+			return errors.Wrapf(err, "failed to evict cache entry %s", e.key)
+		}
+		total -= e.size
+		log.G(ctx).Debugf("cache: entry %s evicted, %d bytes freed", e.key, e.size)
+	}
+	return nil
+}
+
+func (c *Cache) entryDir(key string) string {
+	return filepath.Join(c.root, entriesDir, key)
+}
+
+// lock takes a flock on the cache, it works both across processes and across
+// goroutines since every call opens its own file description.
+func (c *Cache) lock(how int) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(c.root, lockFile), os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open cache lock")
+	}
+	if err := unix.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to lock cache")
+	}
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		if info, err := f.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func copyFile(src, dst string) (File, error) {
+	fsrc, err := os.Open(src)
+	if err != nil {
+		return File{}, err
+	}
+	defer fsrc.Close()
+	fdst, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0444)
+	if err != nil {
+		return File{}, err
+	}
+	defer fdst.Close()
+	digester := digest.Canonical.Digester()
+	n, err := io.Copy(io.MultiWriter(fdst, digester.Hash()), fsrc)
+	if err != nil {
+		return File{}, err
+	}
+	return File{Digest: digester.Digest(), Size: n}, fdst.Sync()
+}
+
+func linkOrCopy(src, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	if _, err := copyFile(src, dst); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestKey(t *testing.T) {
+	if Key("a", "sha256:1") == Key("b", "sha256:1") {
+		t.Error("Key() should depend on the profile")
+	}
+	if Key("a", "sha256:1") == Key("a", "sha256:2") {
+		t.Error("Key() should depend on the chainID")
+	}
+}
+
+func TestCache_StoreAndRestore(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(filepath.Join(t.TempDir(), "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key("profile", "sha256:1")
+	if _, ok := c.Lookup(ctx, key); ok {
+		t.Fatal("Lookup() found entry in empty cache")
+	}
+
+	src := t.TempDir()
+	data := []byte("commit file")
+	if err := c.Store(ctx, key, writeTestFile(t, src, "overlaybd.commit", data)); err != nil {
+		t.Fatal(err)
+	}
+	files, ok := c.Lookup(ctx, key)
+	if !ok {
+		t.Fatal("Lookup() didn't find stored entry")
+	}
+	f := files["overlaybd.commit"]
+	if f.Digest != digest.FromBytes(data) || f.Size != int64(len(data)) {
+		t.Errorf("Lookup() = %+v, unexpected file", files)
+	}
+
+	// the caller keeps its files
+	if _, err := os.Stat(filepath.Join(src, "overlaybd.commit")); err != nil {
+		t.Error(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "layer")
+	if err := c.Restore(ctx, key, dst); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dst, "overlaybd.commit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Restore() content = %q, want %q", got, data)
+	}
+	if err := c.Restore(ctx, Key("profile", "sha256:2"), dst); err == nil {
+		t.Error("Restore() of missing entry should fail")
+	}
+}
+
+func TestCache_Evict(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(filepath.Join(t.TempDir(), "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	file := writeTestFile(t, src, "overlaybd.commit", make([]byte, 10))
+
+	keys := []string{Key("p", "1"), Key("p", "2"), Key("p", "3")}
+	for i, key := range keys[:2] {
+		if err := c.Store(ctx, key, file); err != nil {
+			t.Fatal(err)
+		}
+		// room for two entries
+		c.maxSize = dirSize(c.entryDir(key))*2 + 1
+		// make the access time distinguishable
+		past := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(c.entryDir(key), past, past)
+	}
+	// keys[0] is used again, so keys[1] is the least recently used one
+	if _, ok := c.Lookup(ctx, keys[0]); !ok {
+		t.Fatal("Lookup() didn't find stored entry")
+	}
+	if err := c.Store(ctx, keys[2], file); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false, true} {
+		if _, ok := c.Lookup(ctx, keys[i]); ok != want {
+			t.Errorf("entry %d present = %v, want %v", i, ok, want)
+		}
+	}
+}
+
+func TestCache_ConcurrentStore(t *testing.T) {
+	ctx := context.Background()
+	root := filepath.Join(t.TempDir(), "cache")
+	src := t.TempDir()
+	file := writeTestFile(t, src, "overlaybd.commit", []byte("data"))
+	key := Key("p", "1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// a cache per goroutine, like separate processes sharing the dir
+			c, err := New(root, 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := c.Store(ctx, key, file); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := os.ReadDir(filepath.Join(root, entriesDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d entries stored, want 1", len(entries))
+	}
+	tmps, _ := os.ReadDir(filepath.Join(root, tmpDir))
+	if len(tmps) != 0 {
+		t.Errorf("%d temporary entries left", len(tmps))
+	}
+}
@@ -0,0 +1,624 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package compare finds the differences between two converted images, e.g.
+// the results of two conversion runs of the same source image.
+//
+// Manifests are aligned by platform, and layers by the chainID of the source
+// layer they are converted from. The source image is given by Options.Source,
+// or the subject of the converted manifests pushed as referrers. Without a
+// source, layers are aligned by position.
+package compare
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/containerd/accelerated-container-image/pkg/label"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// keys of the layers added by the convertor on top of the source layers
+	baseLayerKey  = "base"
+	accelLayerKey = "acceleration"
+
+	missing = "<missing>"
+)
+
+type Options struct {
+	// Resolver accesses both images and the source, required
+	Resolver remotes.Resolver
+
+	// Source is the image both images are converted from. If empty, the
+	// subject of the converted manifests is used if any.
+	Source string
+
+	// Files reads the file trees of the turboOCI layers, from the data the
+	// fs meta indexes
+	Files bool
+}
+
+// Difference is a field differing between the two images
+type Difference struct {
+	// Platform of the manifests, empty for an image of a single manifest
+	Platform string
+	// Layer is the key the layers are aligned by, empty for the fields of the
+	// manifest and config
+	Layer string
+	// Field differing, e.g. "digest", "annotations[key]" or "config.Env"
+	Field string
+	A, B  string
+}
+
+func (d Difference) String() string {
+	var where []string
+	if d.Platform != "" {
+		where = append(where, d.Platform)
+	}
+	if d.Layer != "" {
+		where = append(where, "layer "+d.Layer)
+	}
+	where = append(where, d.Field)
+	return fmt.Sprintf("%s: %s != %s", strings.Join(where, " "), d.A, d.B)
+}
+
+// File is an entry of the file tree of a layer
+type File struct {
+	Path     string
+	Mode     os.FileMode
+	Size     int64
+	Linkname string
+}
+
+func (f File) String() string {
+	s := fmt.Sprintf("%s %d %s", f.Mode, f.Size, f.Path)
+	if f.Linkname != "" {
+		s += " -> " + f.Linkname
+	}
+	return s
+}
+
+// Layer is a pair of aligned layers, A or B is nil if the layer is missing in
+// the image
+type Layer struct {
+	Key  string
+	A, B *v1.Descriptor
+	// FilesA and FilesB are the file trees of turboOCI layers, set if
+	// Options.Files is set
+	FilesA, FilesB []File
+}
+
+// Platform is a pair of manifests of the same platform
+type Platform struct {
+	Platform string
+	Layers   []Layer
+}
+
+// Report is the result of Compare
+type Report struct {
+	Differences []Difference
+	Platforms   []Platform
+}
+
+// Equal tells if no difference is found
+func (r *Report) Equal() bool {
+	return len(r.Differences) == 0
+}
+
+// Compare finds the differences between the converted images refA and refB
+func Compare(ctx context.Context, opt Options, refA, refB string) (*Report, error) {
+	if opt.Resolver == nil {
+		return nil, errors.New("resolver is required")
+	}
+	a, err := loadImage(ctx, opt.Resolver, refA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := loadImage(ctx, opt.Resolver, refB)
+	if err != nil {
+		return nil, err
+	}
+	var source *image
+	if opt.Source != "" {
+		if source, err = loadImage(ctx, opt.Resolver, opt.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	alignSingleManifests(a, b)
+
+	c := &comparer{opt: opt, report: &Report{}}
+	c.compareFields("", "", "index annotations", stringMap(a.annotations), stringMap(b.annotations))
+	for _, p := range platformKeys(a.manifests, b.manifests) {
+		ma, mb := a.manifests[p], b.manifests[p]
+		if ma == nil || mb == nil {
+			c.add(Difference{Platform: p, Field: "manifest", A: manifestDigest(ma), B: manifestDigest(mb)})
+			continue
+		}
+		if err := c.comparePlatform(ctx, p, a, ma, b, mb, source); err != nil {
+			return nil, fmt.Errorf("failed to compare %s: %w", platformName(p), err)
+		}
+	}
+	return c.report, nil
+}
+
+type comparer struct {
+	opt    Options
+	report *Report
+}
+
+func (c *comparer) add(d Difference) {
+	c.report.Differences = append(c.report.Differences, d)
+}
+
+func (c *comparer) comparePlatform(ctx context.Context, p string, a *image, ma *manifest, b *image, mb *manifest, source *image) error {
+	if err := a.load(ctx, ma); err != nil {
+		return err
+	}
+	if err := b.load(ctx, mb); err != nil {
+		return err
+	}
+	keysA, err := c.layerKeys(ctx, a, ma, source, p)
+	if err != nil {
+		return err
+	}
+	keysB, err := c.layerKeys(ctx, b, mb, source, p)
+	if err != nil {
+		return err
+	}
+
+	fields := func(m *manifest) map[string]string {
+		return map[string]string{
+			"mediaType":        m.desc.MediaType,
+			"artifactType":     m.manifest.ArtifactType,
+			"config.mediaType": m.manifest.Config.MediaType,
+		}
+	}
+	c.compareFields(p, "", "manifest", fields(ma), fields(mb))
+	c.compareFields(p, "", "manifest annotations", stringMap(ma.manifest.Annotations), stringMap(mb.manifest.Annotations))
+	c.compareFields(p, "", "config", ma.config, mb.config)
+
+	platform := Platform{Platform: p}
+	for _, key := range mergeKeys(keysA, keysB) {
+		l := Layer{Key: key, A: lookupLayer(ma, keysA, key), B: lookupLayer(mb, keysB, key)}
+		if l.A == nil || l.B == nil {
+			c.add(Difference{Platform: p, Layer: key, Field: "layer", A: layerDigest(l.A), B: layerDigest(l.B)})
+		} else {
+			c.compareLayer(p, key, *l.A, *l.B)
+		}
+		if c.opt.Files {
+			if l.FilesA, err = a.files(ctx, l.A); err != nil {
+				return err
+			}
+			if l.FilesB, err = b.files(ctx, l.B); err != nil {
+				return err
+			}
+			if l.FilesA != nil && l.FilesB != nil {
+				c.compareFiles(p, key, l.FilesA, l.FilesB)
+			}
+		}
+		platform.Layers = append(platform.Layers, l)
+	}
+	c.report.Platforms = append(c.report.Platforms, platform)
+	return nil
+}
+
+func (c *comparer) compareLayer(p, key string, a, b v1.Descriptor) {
+	fields := func(d v1.Descriptor) map[string]string {
+		return map[string]string{
+			"mediaType": d.MediaType,
+			"digest":    d.Digest.String(),
+			"size":      fmt.Sprintf("%d", d.Size),
+		}
+	}
+	c.compareFields(p, key, "", fields(a), fields(b))
+	c.compareFields(p, key, "annotations", stringMap(a.Annotations), stringMap(b.Annotations))
+}
+
+func (c *comparer) compareFiles(p, key string, a, b []File) {
+	toMap := func(files []File) map[string]string {
+		m := make(map[string]string, len(files))
+		for _, f := range files {
+			s := fmt.Sprintf("%s %d", f.Mode, f.Size)
+			if f.Linkname != "" {
+				s += " -> " + f.Linkname
+			}
+			m[f.Path] = s
+		}
+		return m
+	}
+	c.compareFields(p, key, "files", toMap(a), toMap(b))
+}
+
+// compareFields reports the keys of a and b with different values, as
+// prefix[key] or prefix.key
+func (c *comparer) compareFields(p, layer, prefix string, a, b map[string]string) {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		va, okA := a[k]
+		vb, okB := b[k]
+		if okA && okB && va == vb {
+			continue
+		}
+		if !okA {
+			va = missing
+		}
+		if !okB {
+			vb = missing
+		}
+		field := k
+		switch {
+		case prefix == "config":
+			field = "config." + k
+		case prefix != "":
+			field = prefix + "[" + k + "]"
+		}
+		c.add(Difference{Platform: p, Layer: layer, Field: field, A: va, B: vb})
+	}
+}
+
+// layerKeys returns the key of each layer of m, which is the chainID of the
+// source layer if the source is known, or the position otherwise. The base
+// layer and the acceleration layer have their own keys.
+func (c *comparer) layerKeys(ctx context.Context, img *image, m *manifest, source *image, p string) ([]string, error) {
+	layers := m.manifest.Layers
+	keys := make([]string, len(layers))
+	converted := 0
+	for i, l := range layers {
+		if l.Annotations[label.AccelerationLayer] == "yes" {
+			keys[i] = accelLayerKey
+			continue
+		}
+		converted++
+	}
+
+	var chainIDs []string
+	src, err := c.sourceManifest(ctx, img, m, source, p)
+	if err != nil {
+		return nil, err
+	}
+	if src != nil {
+		chainIDs = src.chainIDs()
+	}
+	offset := 0
+	switch {
+	case chainIDs != nil && converted == len(chainIDs)+1:
+		// the base layer is added when mkfs is disabled
+		keys[0] = baseLayerKey
+		offset = 1
+	case chainIDs != nil && converted != len(chainIDs):
+		return nil, fmt.Errorf("%d layers of %s can't be aligned with %d source layers", converted, m.desc.Digest, len(chainIDs))
+	}
+	for i := range layers {
+		if keys[i] != "" {
+			continue
+		}
+		if chainIDs != nil {
+			keys[i] = chainIDs[i-offset]
+		} else {
+			keys[i] = fmt.Sprintf("#%d", i)
+		}
+	}
+	return keys, nil
+}
+
+// sourceManifest returns the source manifest of m, from source or the subject
+// of m, nil if unknown
+func (c *comparer) sourceManifest(ctx context.Context, img *image, m *manifest, source *image, p string) (*manifest, error) {
+	var src *manifest
+	var from *image
+	switch {
+	case source != nil:
+		from = source
+		src = source.manifests[p]
+		if src == nil && len(source.manifests) == 1 {
+			// a single manifest image is the source of any platform
+			for _, s := range source.manifests {
+				src = s
+			}
+		}
+		if src == nil {
+			return nil, fmt.Errorf("no source manifest of %s", platformName(p))
+		}
+	case m.manifest.Subject != nil:
+		from = img
+		src = &manifest{desc: *m.manifest.Subject}
+	default:
+		return nil, nil
+	}
+	if err := from.load(ctx, src); err != nil {
+		return nil, fmt.Errorf("failed to load source manifest: %w", err)
+	}
+	return src, nil
+}
+
+type image struct {
+	ref         string
+	fetcher     remotes.Fetcher
+	annotations map[string]string
+	// manifests are keyed by platform, "" for an image of a single manifest
+	manifests map[string]*manifest
+}
+
+type manifest struct {
+	desc     v1.Descriptor
+	manifest v1.Manifest
+	image    v1.Image
+	// config is the flattened config without the diffIDs
+	config map[string]string
+	loaded bool
+}
+
+func (m *manifest) chainIDs() []string {
+	var chain []digest.Digest
+	ids := make([]string, len(m.image.RootFS.DiffIDs))
+	for i, d := range m.image.RootFS.DiffIDs {
+		chain = append(chain, d)
+		ids[i] = identity.ChainID(chain).String()
+	}
+	return ids
+}
+
+func loadImage(ctx context.Context, resolver remotes.Resolver, ref string) (*image, error) {
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fetcher of %s: %w", ref, err)
+	}
+	img := &image{ref: ref, fetcher: fetcher, manifests: map[string]*manifest{}}
+	switch desc.MediaType {
+	case v1.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		img.manifests[""] = &manifest{desc: desc}
+	case v1.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		var index v1.Index
+		if err := fetchJSON(ctx, fetcher, desc, &index); err != nil {
+			return nil, fmt.Errorf("failed to fetch index of %s: %w", ref, err)
+		}
+		img.annotations = index.Annotations
+		for _, m := range index.Manifests {
+			p := "unknown"
+			if m.Platform != nil {
+				p = platforms.Format(*m.Platform)
+			}
+			img.manifests[p] = &manifest{desc: m}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported media type %q of %s", desc.MediaType, ref)
+	}
+	return img, nil
+}
+
+// load fetches the manifest and config of m
+func (img *image) load(ctx context.Context, m *manifest) error {
+	if m.loaded {
+		return nil
+	}
+	if err := fetchJSON(ctx, img.fetcher, m.desc, &m.manifest); err != nil {
+		return fmt.Errorf("failed to fetch manifest %s: %w", m.desc.Digest, err)
+	}
+	rc, err := img.fetcher.Fetch(ctx, m.manifest.Config)
+	if err != nil {
+		return fmt.Errorf("failed to fetch config %s: %w", m.manifest.Config.Digest, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &m.image); err != nil {
+		return fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	// diffIDs are compared with the layers
+	if rootfs, ok := raw["rootfs"].(map[string]any); ok {
+		delete(rootfs, "diff_ids")
+	}
+	m.config = map[string]string{}
+	flatten("", raw, m.config)
+	m.loaded = true
+	return nil
+}
+
+// files lists the file tree of a turboOCI layer from its target data, nil if
+// desc is not a turboOCI layer
+func (img *image) files(ctx context.Context, desc *v1.Descriptor) ([]File, error) {
+	if desc == nil {
+		return nil, nil
+	}
+	target := desc.Annotations[label.TurboOCIDigest]
+	mediaType := desc.Annotations[label.TurboOCIMediaType]
+	if target == "" {
+		target = desc.Annotations[label.FastOCIDigest]
+		mediaType = desc.Annotations[label.FastOCIMediaType]
+	}
+	if target == "" {
+		return nil, nil
+	}
+	dgst, err := digest.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid turboOCI target digest of layer %s: %w", desc.Digest, err)
+	}
+	rc, err := img.fetcher.Fetch(ctx, v1.Descriptor{MediaType: mediaType, Digest: dgst})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch turboOCI target %s: %w", dgst, err)
+	}
+	defer rc.Close()
+	ds, err := compression.DecompressStream(rc)
+	if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+	files := []File{}
+	tr := tar.NewReader(ds)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read turboOCI target %s: %w", dgst, err)
+		}
+		files = append(files, File{
+			Path:     "/" + strings.TrimPrefix(strings.TrimPrefix(hdr.Name, "./"), "/"),
+			Mode:     hdr.FileInfo().Mode(),
+			Size:     hdr.Size,
+			Linkname: hdr.Linkname,
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+func fetchJSON(ctx context.Context, fetcher remotes.Fetcher, desc v1.Descriptor, v any) error {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return json.NewDecoder(rc).Decode(v)
+}
+
+// flatten turns the objects of v into keys separated by dots, other values
+// are kept in JSON
+func flatten(prefix string, v any, out map[string]string) {
+	if m, ok := v.(map[string]any); ok {
+		for k, sub := range m {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flatten(key, sub, out)
+		}
+		return
+	}
+	data, _ := json.Marshal(v)
+	out[prefix] = string(data)
+}
+
+func stringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
+
+// alignSingleManifests keys the manifest of a single manifest image by the
+// platform of the other image, if it has a single manifest too
+func alignSingleManifests(a, b *image) {
+	if len(a.manifests) != 1 || len(b.manifests) != 1 {
+		return
+	}
+	ma, okA := a.manifests[""]
+	mb, okB := b.manifests[""]
+	switch {
+	case okA && !okB:
+		for p := range b.manifests {
+			a.manifests = map[string]*manifest{p: ma}
+		}
+	case okB && !okA:
+		for p := range a.manifests {
+			b.manifests = map[string]*manifest{p: mb}
+		}
+	}
+}
+
+func platformKeys(a, b map[string]*manifest) []string {
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeKeys returns the keys of a followed by the ones only in b
+func mergeKeys(a, b []string) []string {
+	keys := append([]string(nil), a...)
+	seen := make(map[string]bool, len(a))
+	for _, k := range a {
+		seen[k] = true
+	}
+	for _, k := range b {
+		if !seen[k] {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func lookupLayer(m *manifest, keys []string, key string) *v1.Descriptor {
+	for i, k := range keys {
+		if k == key {
+			return &m.manifest.Layers[i]
+		}
+	}
+	return nil
+}
+
+func manifestDigest(m *manifest) string {
+	if m == nil {
+		return missing
+	}
+	return m.desc.Digest.String()
+}
+
+func layerDigest(d *v1.Descriptor) string {
+	if d == nil {
+		return missing
+	}
+	return d.Digest.String()
+}
+
+func platformName(p string) string {
+	if p == "" {
+		return "manifest"
+	}
+	return p
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compare
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/accelerated-container-image/pkg/builder"
+	"github.com/containerd/accelerated-container-image/pkg/builder/testingresources"
+	"github.com/containerd/accelerated-container-image/pkg/utils/faketools"
+)
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+	reg := testingresources.NewHTTPRegistry(t, ctx, testingresources.HTTPRegistryOptions{})
+	binDir := faketools.Install(t)
+
+	convert := func(engine builder.BuilderEngineType, tag string, oci bool) {
+		err := builder.Build(ctx, builder.BuilderOptions{
+			Ref:             reg.Ref("hello-world:amd64"),
+			TargetRef:       reg.Ref("hello-world:" + tag),
+			PlainHTTP:       true,
+			WorkDir:         t.TempDir(),
+			Engine:          engine,
+			Mkfs:            true,
+			Vsize:           64,
+			OCI:             oci,
+			OverlayBDBinDir: binDir,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	convert(builder.TurboOCI, "turbo-1", false)
+	convert(builder.TurboOCI, "turbo-2", false)
+	convert(builder.TurboOCI, "turbo-oci", true)
+
+	resolver, err := builder.NewResolver(builder.BuilderOptions{PlainHTTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := Options{
+		Resolver: resolver,
+		Source:   reg.Ref("hello-world:amd64"),
+		Files:    true,
+	}
+
+	t.Run("equal", func(t *testing.T) {
+		report, err := Compare(ctx, opt, reg.Ref("hello-world:turbo-1"), reg.Ref("hello-world:turbo-2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testingresources.Assert(t, report.Equal(), fmt.Sprintf("unexpected differences %v", report.Differences))
+		testingresources.Assert(t, len(report.Platforms) == 1 && len(report.Platforms[0].Layers) == 1, fmt.Sprintf("unexpected layers %+v", report.Platforms))
+		l := report.Platforms[0].Layers[0]
+		testingresources.Assert(t, l.Key != "#0", "layer isn't aligned by chainID")
+		found := false
+		for _, f := range l.FilesA {
+			found = found || f.Path == "/hello"
+		}
+		testingresources.Assert(t, found, fmt.Sprintf("/hello isn't listed in %v", l.FilesA))
+	})
+
+	t.Run("different", func(t *testing.T) {
+		report, err := Compare(ctx, opt, reg.Ref("hello-world:turbo-1"), reg.Ref("hello-world:turbo-oci"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := map[string]bool{}
+		for _, d := range report.Differences {
+			fields[d.Field] = true
+			testingresources.Assert(t, d.Field != "layer", fmt.Sprintf("layers aren't aligned: %v", d))
+		}
+		testingresources.Assert(t, fields["manifest[mediaType]"], fmt.Sprintf("manifest media type isn't reported: %v", report.Differences))
+		testingresources.Assert(t, fields["mediaType"], fmt.Sprintf("layer media type isn't reported: %v", report.Differences))
+	})
+
+	t.Run("by position", func(t *testing.T) {
+		report, err := Compare(ctx, Options{Resolver: resolver}, reg.Ref("hello-world:turbo-1"), reg.Ref("hello-world:turbo-2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testingresources.Assert(t, report.Equal(), fmt.Sprintf("unexpected differences %v", report.Differences))
+		testingresources.Assert(t, report.Platforms[0].Layers[0].Key == "#0", "layer isn't aligned by position")
+	})
+}
@@ -0,0 +1,270 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/log"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DryRunReport tells how an image would be converted, see Builder.DryRun
+type DryRunReport struct {
+	// Manifests are the image manifests to convert, sorted by platform
+	Manifests []ManifestReport
+}
+
+// ManifestReport tells how an image manifest would be converted
+type ManifestReport struct {
+	Source   v1.Descriptor
+	Platform string
+	// Converted is the result of a previous conversion found in db, the
+	// manifest would be reused as a whole if set. The layers of a reused
+	// manifest are not inspected, only their source descriptor and chainID
+	// are reported.
+	Converted *v1.Descriptor
+	Layers    []LayerReport
+}
+
+// LayerReport tells how a layer would be converted
+type LayerReport struct {
+	Source  v1.Descriptor
+	ChainID string
+	// Compression of the source layer, and the size of its tar
+	Compression      string
+	UncompressedSize int64
+	// Converted is the result of a previous conversion found in the local
+	// cache (Cached is set) or db, the layer would be reused if set
+	Converted *v1.Descriptor
+	Cached    bool
+	// Download is the estimated bytes downloaded to convert the layer
+	Download int64
+	// EstimatedSize is the estimated size of the converted layer, which is
+	// also the upper bound of the data fetched on demand by lazy loading
+	EstimatedSize int64
+}
+
+// Reused tells if the layer would be reused rather than converted
+func (l LayerReport) Reused() bool {
+	return l.Converted != nil
+}
+
+// DryRunSummary is the total of a DryRunReport
+type DryRunSummary struct {
+	Manifests       int
+	ReusedManifests int
+	Layers          int
+	ReusedLayers    int
+	// SourceSize and UncompressedSize are the sizes of the inspected source
+	// layers
+	SourceSize       int64
+	UncompressedSize int64
+	// Download is the estimated bytes downloaded by the conversion
+	Download int64
+	// ConvertedSize is the estimated size of the layers of the converted
+	// images, NewSize the part of them that would be converted and pushed
+	ConvertedSize int64
+	NewSize       int64
+}
+
+// LayerHitRate returns the ratio of layers that would be reused
+func (s DryRunSummary) LayerHitRate() float64 {
+	if s.Layers == 0 {
+		return 0
+	}
+	return float64(s.ReusedLayers) / float64(s.Layers)
+}
+
+// Summary adds up the manifests and layers of the report
+func (r *DryRunReport) Summary() DryRunSummary {
+	var s DryRunSummary
+	for _, m := range r.Manifests {
+		s.Manifests++
+		if m.Converted != nil {
+			s.ReusedManifests++
+		}
+		for _, l := range m.Layers {
+			s.Layers++
+			if m.Converted != nil || l.Reused() {
+				s.ReusedLayers++
+			}
+			if m.Converted != nil {
+				continue
+			}
+			s.SourceSize += l.Source.Size
+			s.UncompressedSize += l.UncompressedSize
+			s.Download += l.Download
+			s.ConvertedSize += l.EstimatedSize
+			if !l.Reused() {
+				s.NewSize += l.EstimatedSize
+			}
+		}
+	}
+	return s
+}
+
+// DryRun resolves opt.Ref and looks up the converted manifests and layers in
+// the local cache and db, without mounting or pushing anything nor running
+// the overlaybd tools. The source layers of the manifests which would be
+// converted are read to get their uncompressed size. For engines added by
+// RegisterEngine, CheckForConvertedManifest and CheckForConvertedLayer are
+// called as is.
+func (b *Builder) DryRun(ctx context.Context) (*DryRunReport, error) {
+	if b.opt.Logger != nil {
+		ctx = log.WithLogger(ctx, b.opt.Logger)
+	}
+	counter := newTransferCounter()
+	gb := &graphBuilder{
+		BuilderOptions: b.opt,
+		limits:         b.limits,
+		counter:        counter,
+		dryRun:         &dryRunCollector{},
+	}
+	err := gb.Build(ctx)
+	b.stats = counter.stats()
+	if err != nil {
+		return nil, err
+	}
+	return gb.dryRun.report(), nil
+}
+
+// dryRunCollector gathers the reports of manifests planned concurrently
+type dryRunCollector struct {
+	mu        sync.Mutex
+	manifests []ManifestReport
+}
+
+func (c *dryRunCollector) add(m ManifestReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.manifests = append(c.manifests, m)
+}
+
+func (c *dryRunCollector) report() *DryRunReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	manifests := append([]ManifestReport(nil), c.manifests...)
+	sort.SliceStable(manifests, func(i, j int) bool {
+		return manifests[i].Platform < manifests[j].Platform
+	})
+	return &DryRunReport{Manifests: manifests}
+}
+
+// planOne reports how the manifest of engine would be converted
+func (b *graphBuilder) planOne(ctx context.Context, engine Engine, base *builderEngineBase, src v1.Descriptor, platform string) (ManifestReport, error) {
+	defer engine.Cleanup()
+	report := ManifestReport{
+		Source:   src,
+		Platform: platform,
+		Layers:   make([]LayerReport, len(base.manifest.Layers)),
+	}
+	chainIDs := base.layerChainIDs()
+	for idx, layer := range base.manifest.Layers {
+		report.Layers[idx] = LayerReport{Source: layer, ChainID: chainIDs[idx]}
+	}
+	if desc, err := engine.CheckForConvertedManifest(ctx); err == nil && desc.Digest != "" {
+		report.Converted = &desc
+		return report, nil
+	}
+
+	for idx := range report.Layers {
+		l := &report.Layers[idx]
+		if desc, err := engine.CheckForConvertedLayer(ctx, idx); err == nil {
+			l.Converted = &desc
+		}
+		comp, size, err := measureLayer(ctx, base.fetcher, l.Source)
+		if err != nil {
+			return report, fmt.Errorf("failed to read layer %d: %w", idx, err)
+		}
+		l.Compression = compressionName(comp)
+		l.UncompressedSize = size
+		b.estimateLayer(engine, idx, l, comp)
+	}
+	return report, nil
+}
+
+// estimateLayer fills the download and converted size of the layer, in the
+// way the builtin engines convert it
+func (b *graphBuilder) estimateLayer(engine Engine, idx int, l *LayerReport, comp compression.Compression) {
+	switch e := engine.(type) {
+	case *overlaybdBuilderEngine:
+		if l.Converted == nil {
+			// zfile is compressed, the uncompressed size is the upper bound
+			l.Download = l.Source.Size
+			l.EstimatedSize = l.UncompressedSize
+			return
+		}
+		l.Cached = e.overlaybdLayers[idx].fromCache
+		if !l.Cached {
+			l.Download = l.Converted.Size
+		}
+		l.EstimatedSize = l.Converted.Size
+	case *turboOCIBuilderEngine:
+		// the source layer is always downloaded, and is the data of the
+		// converted layer unless it's zstd, the fs meta is omitted
+		l.Cached = l.Converted != nil
+		l.Download = l.Source.Size
+		l.EstimatedSize = l.Source.Size
+		if comp == compression.Zstd {
+			l.EstimatedSize = l.UncompressedSize
+		}
+	default:
+		l.Download = l.Source.Size
+		l.EstimatedSize = l.UncompressedSize
+		if l.Converted != nil {
+			l.Download = 0
+			l.EstimatedSize = l.Converted.Size
+		}
+	}
+}
+
+// measureLayer reads the layer to get its compression and uncompressed size
+func measureLayer(ctx context.Context, fetcher remotes.Fetcher, desc v1.Descriptor) (compression.Compression, int64, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return compression.Uncompressed, 0, err
+	}
+	defer rc.Close()
+	ds, err := compression.DecompressStream(rc)
+	if err != nil {
+		return compression.Uncompressed, 0, err
+	}
+	defer ds.Close()
+	size, err := io.Copy(io.Discard, ds)
+	if err != nil {
+		return compression.Uncompressed, 0, err
+	}
+	return ds.GetCompression(), size, nil
+}
+
+func compressionName(comp compression.Compression) string {
+	switch comp {
+	case compression.Gzip:
+		return "gzip"
+	case compression.Zstd:
+		return "zstd"
+	default:
+		return "uncompressed"
+	}
+}
@@ -0,0 +1,118 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/containerd/accelerated-container-image/pkg/builder/testingresources"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func Test_builder_DryRun(t *testing.T) {
+	ctx := context.Background()
+	reg := testingresources.NewHTTPRegistry(t, ctx, testingresources.HTTPRegistryOptions{})
+	db := testingresources.NewLocalDB()
+	binDir := t.TempDir() // no tool is expected to run
+
+	newBuilder := func(t *testing.T) *Builder {
+		b, err := NewBuilder(BuilderOptions{
+			Ref:             reg.Ref("hello-world:amd64"),
+			TargetRef:       reg.Ref("hello-world:obd"),
+			PlainHTTP:       true,
+			WorkDir:         t.TempDir(),
+			Engine:          Overlaybd,
+			Mkfs:            true,
+			Vsize:           64,
+			DB:              db,
+			OverlayBDBinDir: binDir,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	noWrites := func(t *testing.T) {
+		for _, req := range reg.Requests() {
+			method, _, _ := strings.Cut(req, " ")
+			testingresources.Assert(t, method == "GET" || method == "HEAD", fmt.Sprintf("unexpected request %s", req))
+		}
+	}
+
+	var chainID string
+	t.Run("convert", func(t *testing.T) {
+		report, err := newBuilder(t).DryRun(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testingresources.Assert(t, len(report.Manifests) == 1, fmt.Sprintf("unexpected manifests %+v", report.Manifests))
+		m := report.Manifests[0]
+		testingresources.Assert(t, m.Converted == nil && len(m.Layers) == 1, fmt.Sprintf("unexpected manifest %+v", m))
+		l := m.Layers[0]
+		chainID = l.ChainID
+		testingresources.Assert(t, !l.Reused() && l.Compression == "gzip", fmt.Sprintf("unexpected layer %+v", l))
+		testingresources.Assert(t, l.Source.Size == testingresources.DockerV2_Manifest_Simple_Layer_0_Size, "unexpected source size")
+		testingresources.Assert(t, l.UncompressedSize > l.Source.Size, fmt.Sprintf("unexpected uncompressed size %d", l.UncompressedSize))
+		testingresources.Assert(t, l.Download == l.Source.Size, fmt.Sprintf("unexpected download %d", l.Download))
+
+		s := report.Summary()
+		testingresources.Assert(t, s.Layers == 1 && s.ReusedLayers == 0 && s.LayerHitRate() == 0, fmt.Sprintf("unexpected summary %+v", s))
+		testingresources.Assert(t, s.NewSize == l.UncompressedSize && s.ConvertedSize == s.NewSize, fmt.Sprintf("unexpected summary %+v", s))
+		noWrites(t)
+	})
+
+	t.Run("reuse layer", func(t *testing.T) {
+		// any blob present in the repo will do
+		err := db.CreateLayerEntry(ctx, reg.Host(), "hello-world", testingresources.DockerV2_Manifest_Simple_Layer_0_Digest, chainID, testingresources.DockerV2_Manifest_Simple_Layer_0_Size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := newBuilder(t).DryRun(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := report.Manifests[0].Layers[0]
+		testingresources.Assert(t, l.Reused() && !l.Cached, fmt.Sprintf("layer isn't reused: %+v", l))
+		testingresources.Assert(t, l.Download == testingresources.DockerV2_Manifest_Simple_Layer_0_Size, fmt.Sprintf("unexpected download %d", l.Download))
+		s := report.Summary()
+		testingresources.Assert(t, s.ReusedLayers == 1 && s.LayerHitRate() == 1 && s.NewSize == 0, fmt.Sprintf("unexpected summary %+v", s))
+		noWrites(t)
+	})
+
+	t.Run("reuse manifest", func(t *testing.T) {
+		// the source manifest stands in for a converted one
+		err := db.CreateManifestEntry(ctx, reg.Host(), "hello-world", v1.MediaTypeImageManifest,
+			testingresources.DockerV2_Manifest_Simple_Digest, testingresources.DockerV2_Manifest_Simple_Digest, testingresources.DockerV2_Manifest_Simple_Size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := newBuilder(t)
+		b.opt.OCI = true
+		report, err := b.DryRun(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := report.Manifests[0]
+		testingresources.Assert(t, m.Converted != nil && m.Converted.Digest == testingresources.DockerV2_Manifest_Simple_Digest, fmt.Sprintf("manifest isn't reused: %+v", m))
+		s := report.Summary()
+		testingresources.Assert(t, s.ReusedManifests == 1 && s.Download == 0, fmt.Sprintf("unexpected summary %+v", s))
+		noWrites(t)
+	})
+}
@@ -0,0 +1,472 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// defaultMaxConnsPerHost is the http concurrency to a registry host
+	defaultMaxConnsPerHost = 32
+
+	defaultDialTimeout = 30 * time.Second
+
+	// rateLimitChunk is the largest read or write done at once when a rate
+	// limit is set, so that the limit is applied smoothly
+	rateLimitChunk = 32 << 10
+)
+
+// NetworkOptions controls how the registries are accessed. The rate limits
+// apply to fetches and pushes of any resolver, the other options only to the
+// http client created by NewResolver when BuilderOptions.HTTPClient is nil.
+type NetworkOptions struct {
+	// DownloadRateLimit and UploadRateLimit limit the total throughput of a
+	// Builder in bytes per second, 0 means no limit
+	DownloadRateLimit int64
+	UploadRateLimit   int64
+
+	// PerHostDownloadRateLimit and PerHostUploadRateLimit limit the
+	// throughput to each registry host in bytes per second, 0 means no limit
+	PerHostDownloadRateLimit int64
+	PerHostUploadRateLimit   int64
+
+	// MaxConnsPerHost limits the connections to each registry host, 0 means 32
+	MaxConnsPerHost int
+
+	// Proxy is the URL of the http proxy. If empty, the proxy is taken from
+	// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy string
+
+	// DialTimeout limits the time to connect to a registry, 0 means 30s.
+	// ResponseHeaderTimeout limits the time to wait for the response headers
+	// of a request, 0 means no limit.
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+func (opt NetworkOptions) validate() error {
+	if opt.DownloadRateLimit < 0 || opt.UploadRateLimit < 0 || opt.PerHostDownloadRateLimit < 0 || opt.PerHostUploadRateLimit < 0 {
+		return fmt.Errorf("rate limits can't be negative")
+	}
+	if opt.MaxConnsPerHost < 0 {
+		return fmt.Errorf("max connections per host can't be negative")
+	}
+	if opt.DialTimeout < 0 || opt.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("timeouts can't be negative")
+	}
+	if opt.Proxy != "" {
+		if _, err := url.Parse(opt.Proxy); err != nil {
+			return fmt.Errorf("invalid proxy %q: %w", opt.Proxy, err)
+		}
+	}
+	return nil
+}
+
+func (opt NetworkOptions) proxy() (func(*http.Request) (*url.URL, error), error) {
+	if opt.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(opt.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", opt.Proxy, err)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// RegistryOptions overrides how a registry host is accessed
+type RegistryOptions struct {
+	// Auth is user[:password]
+	Auth      string
+	PlainHTTP bool
+	CertOption
+
+	// Mirrors are tried in order before the registry to resolve and fetch
+	// images, they are accessed with their own RegistryOptions if set, or
+	// with the options of the registry
+	Mirrors []string
+
+	// DownloadRateLimit and UploadRateLimit limit the throughput to the host
+	// in bytes per second, 0 means the per host limits of NetworkOptions
+	DownloadRateLimit int64
+	UploadRateLimit   int64
+}
+
+// registryHosts configures the hosts of the docker resolver. The http clients
+// and authorizers are created once for the default options and every entry of
+// BuilderOptions.Registries, so that tokens are shared by fetches and pushes.
+type registryHosts struct {
+	opt         BuilderOptions
+	clients     map[string]*http.Client
+	authorizers map[string]docker.Authorizer
+}
+
+func newRegistryHosts(opt BuilderOptions) (*registryHosts, error) {
+	h := &registryHosts{
+		opt:         opt,
+		clients:     make(map[string]*http.Client),
+		authorizers: make(map[string]docker.Authorizer),
+	}
+	keys := []string{""}
+	for host := range opt.Registries {
+		keys = append(keys, host)
+	}
+	for _, key := range keys {
+		ro := h.options(key)
+		client := opt.HTTPClient
+		if client == nil {
+			var err error
+			if client, err = newHTTPClient(ro.CertOption, opt.NetworkOptions); err != nil {
+				if key != "" {
+					return nil, fmt.Errorf("registry %s: %w", key, err)
+				}
+				return nil, err
+			}
+		}
+		h.clients[key] = client
+		h.authorizers[key] = docker.NewDockerAuthorizer(
+			docker.WithAuthClient(client),
+			docker.WithAuthHeader(make(http.Header)),
+			docker.WithAuthCreds(func(string) (string, string, error) {
+				if i := strings.IndexByte(ro.Auth, ':'); i > 0 {
+					return ro.Auth[0:i], ro.Auth[i+1:], nil
+				}
+				return "", "", nil
+			}),
+		)
+	}
+	return h, nil
+}
+
+// options returns the options of the entry key of BuilderOptions.Registries,
+// "" means the default options
+func (h *registryHosts) options(key string) RegistryOptions {
+	if ro, ok := h.opt.Registries[key]; ok && key != "" {
+		return ro
+	}
+	return RegistryOptions{
+		Auth:       h.opt.Auth,
+		PlainHTTP:  h.opt.PlainHTTP,
+		CertOption: h.opt.CertOption,
+	}
+}
+
+// hosts returns the mirrors of host, able to pull and resolve only, followed
+// by host itself
+func (h *registryHosts) hosts(host string) ([]docker.RegistryHost, error) {
+	key := h.key(host, "")
+	var result []docker.RegistryHost
+	for _, mirror := range h.options(key).Mirrors {
+		mirrorHosts, err := h.configure(mirror, h.key(mirror, key))
+		if err != nil {
+			return nil, err
+		}
+		for i := range mirrorHosts {
+			mirrorHosts[i].Capabilities = docker.HostCapabilityPull | docker.HostCapabilityResolve
+		}
+		result = append(result, mirrorHosts...)
+	}
+	origin, err := h.configure(host, key)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, origin...), nil
+}
+
+// key returns host if it has its own options, fallback otherwise
+func (h *registryHosts) key(host, fallback string) string {
+	if _, ok := h.opt.Registries[host]; ok {
+		return host
+	}
+	return fallback
+}
+
+func (h *registryHosts) configure(host, key string) ([]docker.RegistryHost, error) {
+	plainHTTP := h.options(key).PlainHTTP
+	return docker.ConfigureDefaultRegistries(
+		docker.WithAuthorizer(h.authorizers[key]),
+		docker.WithClient(h.clients[key]),
+		docker.WithPlainHTTP(func(s string) (bool, error) {
+			if plainHTTP {
+				return docker.MatchAllHosts(s)
+			}
+			return false, nil
+		}),
+	)(host)
+}
+
+// TransferStats counts the bytes fetched from and pushed to the registries
+// during a conversion
+type TransferStats struct {
+	Downloaded int64
+	Uploaded   int64
+	Duration   time.Duration
+}
+
+// DownloadThroughput returns the average download throughput in bytes per second
+func (s TransferStats) DownloadThroughput() float64 {
+	return throughput(s.Downloaded, s.Duration)
+}
+
+// UploadThroughput returns the average upload throughput in bytes per second
+func (s TransferStats) UploadThroughput() float64 {
+	return throughput(s.Uploaded, s.Duration)
+}
+
+func throughput(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// rateLimiter is a token bucket of rate bytes per second, with a burst of one
+// second. A nil rateLimiter doesn't limit.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	// next is when the bytes reserved so far are paid off
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate)}
+}
+
+// wait blocks until n bytes can be transferred
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if burst := now.Add(-time.Second); l.next.Before(burst) {
+		l.next = burst
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// transferLimits holds the rate limiters of a Builder, shared by its
+// conversions
+type transferLimits struct {
+	opt        NetworkOptions
+	registries map[string]RegistryOptions
+	download   *rateLimiter
+	upload     *rateLimiter
+
+	mu           sync.Mutex
+	hostDownload map[string]*rateLimiter
+	hostUpload   map[string]*rateLimiter
+}
+
+func newTransferLimits(opt NetworkOptions, registries map[string]RegistryOptions) *transferLimits {
+	return &transferLimits{
+		opt:          opt,
+		registries:   registries,
+		download:     newRateLimiter(opt.DownloadRateLimit),
+		upload:       newRateLimiter(opt.UploadRateLimit),
+		hostDownload: make(map[string]*rateLimiter),
+		hostUpload:   make(map[string]*rateLimiter),
+	}
+}
+
+func (t *transferLimits) hostLimiter(limiters map[string]*rateLimiter, host string, rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := limiters[host]
+	if !ok {
+		l = newRateLimiter(rate)
+		limiters[host] = l
+	}
+	return l
+}
+
+// hostRate returns the rate limit of host set by its RegistryOptions, or by
+// the per host limits
+func (t *transferLimits) hostRate(host string, upload bool) int64 {
+	ro := t.registries[host]
+	if upload {
+		if ro.UploadRateLimit > 0 {
+			return ro.UploadRateLimit
+		}
+		return t.opt.PerHostUploadRateLimit
+	}
+	if ro.DownloadRateLimit > 0 {
+		return ro.DownloadRateLimit
+	}
+	return t.opt.PerHostDownloadRateLimit
+}
+
+// transferCounter counts the bytes transferred by one conversion
+type transferCounter struct {
+	start      time.Time
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+}
+
+func newTransferCounter() *transferCounter {
+	return &transferCounter{start: time.Now()}
+}
+
+func (c *transferCounter) stats() TransferStats {
+	return TransferStats{
+		Downloaded: c.downloaded.Load(),
+		Uploaded:   c.uploaded.Load(),
+		Duration:   time.Since(c.start),
+	}
+}
+
+// fetcher wraps f to count and limit the fetches from host
+func (t *transferLimits) fetcher(f remotes.Fetcher, host string, counter *transferCounter) remotes.Fetcher {
+	return &limitedFetcher{
+		Fetcher:  f,
+		limiters: []*rateLimiter{t.download, t.hostLimiter(t.hostDownload, host, t.hostRate(host, false))},
+		counter:  &counter.downloaded,
+	}
+}
+
+// pusher wraps p to count and limit the pushes to host
+func (t *transferLimits) pusher(p remotes.Pusher, host string, counter *transferCounter) remotes.Pusher {
+	return &limitedPusher{
+		Pusher:   p,
+		limiters: []*rateLimiter{t.upload, t.hostLimiter(t.hostUpload, host, t.hostRate(host, true))},
+		counter:  &counter.uploaded,
+	}
+}
+
+type limitedFetcher struct {
+	remotes.Fetcher
+	limiters []*rateLimiter
+	counter  *atomic.Int64
+}
+
+func (f *limitedFetcher) Fetch(ctx context.Context, desc v1.Descriptor) (io.ReadCloser, error) {
+	rc, err := f.Fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedReader{ReadCloser: rc, ctx: ctx, limiters: f.limiters, counter: f.counter}, nil
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*rateLimiter
+	counter  *atomic.Int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk && limited(r.limiters) {
+		p = p[:rateLimitChunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.counter.Add(int64(n))
+	for _, l := range r.limiters {
+		if werr := l.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type limitedPusher struct {
+	remotes.Pusher
+	limiters []*rateLimiter
+	counter  *atomic.Int64
+}
+
+func (p *limitedPusher) Push(ctx context.Context, desc v1.Descriptor) (content.Writer, error) {
+	w, err := p.Pusher.Push(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedWriter{Writer: w, ctx: ctx, limiters: p.limiters, counter: p.counter}, nil
+}
+
+type limitedWriter struct {
+	content.Writer
+	ctx      context.Context
+	limiters []*rateLimiter
+	counter  *atomic.Int64
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > rateLimitChunk && limited(w.limiters) {
+			chunk = chunk[:rateLimitChunk]
+		}
+		for _, l := range w.limiters {
+			if err := l.wait(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.Writer.Write(chunk)
+		written += n
+		w.counter.Add(int64(n))
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func limited(limiters []*rateLimiter) bool {
+	for _, l := range limiters {
+		if l != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/accelerated-container-image/pkg/builder/testingresources"
+	"github.com/containerd/accelerated-container-image/pkg/utils/faketools"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := newRateLimiter(100 << 10)
+
+	start := time.Now()
+	// the first second is the burst
+	if err := l.wait(ctx, 100<<10); err != nil {
+		t.Fatal(err)
+	}
+	testingresources.Assert(t, time.Since(start) < 100*time.Millisecond, "burst is limited")
+	if err := l.wait(ctx, 20<<10); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	testingresources.Assert(t, elapsed >= 150*time.Millisecond, fmt.Sprintf("waited %s, expected 200ms", elapsed))
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	testingresources.Assert(t, l.wait(cctx, 100<<10) != nil, "wait isn't canceled")
+
+	var unlimited *rateLimiter
+	testingresources.Assert(t, unlimited.wait(ctx, 1<<30) == nil, "nil limiter blocks")
+}
+
+func Test_newHTTPClient(t *testing.T) {
+	client, err := newHTTPClient(CertOption{}, NetworkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := client.Transport.(*http.Transport)
+	testingresources.Assert(t, transport.MaxConnsPerHost == defaultMaxConnsPerHost, "unexpected default max connections")
+	testingresources.Assert(t, transport.Proxy != nil, "proxy from environment isn't used")
+
+	client, err = newHTTPClient(CertOption{}, NetworkOptions{
+		MaxConnsPerHost:       4,
+		Proxy:                 "http://proxy.example:3128",
+		ResponseHeaderTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport = client.Transport.(*http.Transport)
+	testingresources.Assert(t, transport.MaxConnsPerHost == 4, "max connections isn't set")
+	testingresources.Assert(t, transport.ResponseHeaderTimeout == time.Minute, "response header timeout isn't set")
+	req, _ := http.NewRequest(http.MethodGet, "https://registry.example/v2/", nil)
+	proxy, err := transport.Proxy(req)
+	testingresources.Assert(t, err == nil && proxy.Host == "proxy.example:3128", fmt.Sprintf("unexpected proxy %v", proxy))
+
+	_, err = NewBuilder(BuilderOptions{NetworkOptions: NetworkOptions{DownloadRateLimit: -1}})
+	testingresources.Assert(t, err != nil, "negative rate limit is accepted")
+}
+
+// Test_builder_Build_NetworkOptions converts through the http registry used as
+// a proxy for an unresolvable host, with rate limits
+func Test_builder_Build_NetworkOptions(t *testing.T) {
+	ctx := context.Background()
+	reg := testingresources.NewHTTPRegistry(t, ctx, testingresources.HTTPRegistryOptions{})
+	const limit = 16 << 10
+
+	b, err := NewBuilder(BuilderOptions{
+		Ref:             "registry.invalid/hello-world:amd64",
+		TargetRef:       "registry.invalid/hello-world:obd",
+		PlainHTTP:       true,
+		WorkDir:         t.TempDir(),
+		Engine:          Overlaybd,
+		Mkfs:            true,
+		Vsize:           64,
+		OverlayBDBinDir: faketools.Install(t),
+		NetworkOptions: NetworkOptions{
+			Proxy:                    "http://" + reg.Host(),
+			PerHostDownloadRateLimit: limit,
+			UploadRateLimit:          limit,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// registry.invalid can only be reached through the proxy
+	testingresources.Assert(t, len(reg.Requests()) > 0, "registry isn't accessed through the proxy")
+
+	stats := b.Stats()
+	testingresources.Assert(t, stats.Downloaded > 0 && stats.Uploaded > 0, fmt.Sprintf("transfers aren't counted: %+v", stats))
+	// a second of burst is allowed
+	expected := time.Duration(float64(stats.Downloaded-limit)/limit*float64(time.Second)) - 100*time.Millisecond
+	testingresources.Assert(t, stats.Duration >= expected, fmt.Sprintf("download of %d bytes took %s, expected at least %s", stats.Downloaded, stats.Duration, expected))
+	testingresources.Assert(t, stats.DownloadThroughput() > 0 && stats.UploadThroughput() > 0, "throughput isn't reported")
+}
+
+// Test_builder_Build_Registries pulls from a mirror without auth, and pushes
+// to a registry with its own credentials
+func Test_builder_Build_Registries(t *testing.T) {
+	ctx := context.Background()
+	origin := testingresources.NewHTTPRegistry(t, ctx, testingresources.HTTPRegistryOptions{Username: "user", Password: "pass"})
+	mirror := testingresources.NewHTTPRegistry(t, ctx, testingresources.HTTPRegistryOptions{})
+
+	b, err := NewBuilder(BuilderOptions{
+		Ref:             origin.Ref("hello-world:amd64"),
+		TargetRef:       origin.Ref("hello-world:obd"),
+		WorkDir:         t.TempDir(),
+		Engine:          Overlaybd,
+		Mkfs:            true,
+		Vsize:           64,
+		OverlayBDBinDir: faketools.Install(t),
+		Registries: map[string]RegistryOptions{
+			origin.Host(): {
+				Auth:      "user:pass",
+				PlainHTTP: true,
+				Mirrors:   []string{mirror.Host()},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(reg *testingresources.HTTPRegistry, prefix string) int {
+		n := 0
+		for _, req := range reg.Requests() {
+			if strings.HasPrefix(req, prefix) {
+				n++
+			}
+		}
+		return n
+	}
+	testingresources.Assert(t, count(mirror, "GET /v2/hello-world/blobs/") > 0, "layers aren't fetched from the mirror")
+	testingresources.Assert(t, count(origin, "GET /v2/hello-world/blobs/") == 0, "layers are fetched from the registry")
+	testingresources.Assert(t, count(mirror, "PUT ") == 0, "mirror is pushed to")
+	testingresources.Assert(t, count(origin, "PUT /v2/hello-world/manifests/obd") == 1, "converted image isn't pushed")
+
+	_, err = NewBuilder(BuilderOptions{Registries: map[string]RegistryOptions{"registry.example": {UploadRateLimit: -1}}})
+	testingresources.Assert(t, err != nil, "negative registry rate limit is accepted")
+}
@@ -23,19 +23,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path"
+	"strconv"
 
+	"github.com/containerd/accelerated-container-image/pkg/builder/cache"
 	"github.com/containerd/accelerated-container-image/pkg/label"
 	sn "github.com/containerd/accelerated-container-image/pkg/types"
 	"github.com/containerd/accelerated-container-image/pkg/utils"
 	"github.com/containerd/accelerated-container-image/pkg/version"
 	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
 	"github.com/opencontainers/go-digest"
-	"github.com/opencontainers/image-spec/identity"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -48,16 +50,19 @@ type overlaybdConvertResult struct {
 	desc      specs.Descriptor
 	chainID   string
 	fromDedup bool
+	fromCache bool
 }
 
 type overlaybdBuilderEngine struct {
 	*builderEngineBase
 	disableSparse   bool
+	zfileAlgorithm  string
+	zfileBlockSize  int
 	overlaybdConfig *sn.OverlayBDBSConfig
 	overlaybdLayers []overlaybdConvertResult
 }
 
-func NewOverlayBDBuilderEngine(base *builderEngineBase) builderEngine {
+func NewOverlayBDBuilderEngine(base *builderEngineBase) Engine {
 	config := &sn.OverlayBDBSConfig{
 		Lowers:     []sn.OverlayBDBSConfigLower{},
 		ResultFile: "",
@@ -66,17 +71,11 @@ func NewOverlayBDBuilderEngine(base *builderEngineBase) builderEngine {
 		config.Lowers = append(config.Lowers, sn.OverlayBDBSConfigLower{
 			File: overlaybdBaseLayer,
 		})
-		logrus.Infof("using default baselayer")
+		log.L.Infof("using default baselayer")
 	}
 
 	overlaybdLayers := make([]overlaybdConvertResult, len(base.manifest.Layers))
-
-	var chain []digest.Digest
-	srcDiffIDs := base.config.RootFS.DiffIDs
-
-	for i := 0; i < len(base.manifest.Layers); i++ {
-		chain = append(chain, srcDiffIDs[i])
-		chainID := identity.ChainID(chain).String()
+	for i, chainID := range base.layerChainIDs() {
 		overlaybdLayers[i].chainID = chainID
 	}
 
@@ -105,12 +104,12 @@ func (e *overlaybdBuilderEngine) BuildLayer(ctx context.Context, idx int) error
 		// commit file is not present
 	} else {
 		commitFilePresent = true
-		logrus.Debugf("layer %d commit file detected", idx)
+		log.G(ctx).Debugf("layer %d commit file detected", idx)
 	}
 	if e.overlaybdLayers[idx].fromDedup {
 		// check if the previously converted layer is present
 		if commitFilePresent {
-			logrus.Debugf("layer %d is from dedup", idx)
+			log.G(ctx).Debugf("layer %d is from dedup", idx)
 		} else {
 			return fmt.Errorf("layer %d is from dedup but commit file is missing", idx)
 		}
@@ -198,6 +197,9 @@ func (e *overlaybdBuilderEngine) UploadImage(ctx context.Context) (specs.Descrip
 		e.manifest.Layers = append([]specs.Descriptor{baseDesc}, e.manifest.Layers...)
 		e.config.RootFS.DiffIDs = append([]digest.Digest{baseDesc.Digest}, e.config.RootFS.DiffIDs...)
 	}
+	if err := e.appendAccelerationLayer(ctx); err != nil {
+		return specs.Descriptor{}, err
+	}
 	if e.referrer {
 		e.manifest.ArtifactType = ArtifactTypeOverlaybd
 		e.manifest.Subject = &specs.Descriptor{
@@ -210,9 +212,26 @@ func (e *overlaybdBuilderEngine) UploadImage(ctx context.Context) (specs.Descrip
 }
 
 func (e *overlaybdBuilderEngine) CheckForConvertedLayer(ctx context.Context, idx int) (specs.Descriptor, error) {
+	// the local cache is preferred as nothing needs to be downloaded
+	if desc, ok := e.checkForCachedLayer(ctx, idx); ok {
+		return desc, nil
+	}
 	if e.db == nil {
 		return specs.Descriptor{}, errdefs.ErrNotFound
 	}
+	find := func(ctx context.Context) (specs.Descriptor, error) {
+		return e.findConvertedLayer(ctx, idx)
+	}
+	desc, err := find(ctx)
+	if !errdefs.IsNotFound(err) || e.leases == nil {
+		return desc, err
+	}
+	// another worker may be converting the same layer, wait for its result
+	return e.leases.AcquireOrWait(ctx, e.overlaybdLayers[idx].chainID, e.profile(), find)
+}
+
+// findConvertedLayer finds the converted layer in db and validates its presence in registry
+func (e *overlaybdBuilderEngine) findConvertedLayer(ctx context.Context, idx int) (specs.Descriptor, error) {
 	chainID := e.overlaybdLayers[idx].chainID
 
 	// try to find the layer in the target repo
@@ -227,10 +246,10 @@ func (e *overlaybdBuilderEngine) CheckForConvertedLayer(ctx context.Context, idx
 
 		if err == nil {
 			rc.Close()
-			logrus.Infof("layer %d found in remote with chainID %s", idx, chainID)
+			log.G(ctx).Infof("layer %d found in remote with chainID %s", idx, chainID)
 			return desc, nil
 		}
-		if errdefs.IsNotFound(err) {
+		if errdefs.IsNotFound(err) && !e.dryRun {
 			// invalid record in db, which is not found in registry, remove it
 			err := e.db.DeleteLayerEntry(ctx, e.host, e.repository, chainID)
 			if err != nil {
@@ -248,10 +267,20 @@ func (e *overlaybdBuilderEngine) CheckForConvertedLayer(ctx context.Context, idx
 			Digest:    entry.ConvertedDigest,
 			Size:      entry.DataSize,
 			Annotations: map[string]string{
-				fmt.Sprintf("%s.%s", labelDistributionSource, e.host): entry.Repository,
+				distributionSourceLabel(e.host): entry.Repository,
 			},
 		}
 
+		if e.dryRun {
+			// the layer would be mounted if it's present in the other repo
+			if e.blobExists(ctx, entry.Repository, desc) {
+				desc.Annotations = nil
+				log.G(ctx).Infof("layer %d found in %s with chainID %s", idx, entry.Repository, chainID)
+				return desc, nil
+			}
+			continue
+		}
+
 		_, err := e.pusher.Push(ctx, desc)
 		if errdefs.IsAlreadyExists(err) {
 			desc.Annotations = nil
@@ -260,21 +289,57 @@ func (e *overlaybdBuilderEngine) CheckForConvertedLayer(ctx context.Context, idx
 				continue // try a different repo if available
 			}
 
-			logrus.Infof("layer %d mount from %s was successful", idx, entry.Repository)
-			logrus.Infof("layer %d found in remote with chainID %s", idx, chainID)
+			log.G(ctx).Infof("layer %d mount from %s was successful", idx, entry.Repository)
+			log.G(ctx).Infof("layer %d found in remote with chainID %s", idx, chainID)
 			return desc, nil
 		}
 	}
 
-	logrus.Infof("layer %d not found in remote", idx)
+	log.G(ctx).Infof("layer %d not found in remote", idx)
 	return specs.Descriptor{}, errdefs.ErrNotFound
 }
 
+func (e *overlaybdBuilderEngine) checkForCachedLayer(ctx context.Context, idx int) (specs.Descriptor, bool) {
+	if e.cache == nil {
+		return specs.Descriptor{}, false
+	}
+	files, ok := e.cache.Lookup(ctx, e.cacheKey(idx))
+	if !ok {
+		return specs.Descriptor{}, false
+	}
+	f, ok := files[commitFile]
+	if !ok {
+		return specs.Descriptor{}, false
+	}
+	log.G(ctx).Infof("layer %d found in cache with chainID %s", idx, e.overlaybdLayers[idx].chainID)
+	e.overlaybdLayers[idx].fromCache = true
+	return specs.Descriptor{
+		MediaType: e.mediaTypeImageLayer(),
+		Digest:    f.Digest,
+		Size:      f.Size,
+	}, true
+}
+
+// profile covers the options changing the content of the commit file
+func (e *overlaybdBuilderEngine) profile() string {
+	profile := fmt.Sprintf("overlaybd;version=%s;mkfs=%v;vsize=%d", version.OverlayBDVersionNumber, e.mkfs, e.vsize)
+	// zfile options are only added when set, to keep the keys of existing layers
+	if e.zfileAlgorithm != "" || e.zfileBlockSize != 0 {
+		profile += fmt.Sprintf(";zfile=%s/%d", e.zfileAlgorithm, e.zfileBlockSize)
+	}
+	return profile
+}
+
+func (e *overlaybdBuilderEngine) cacheKey(idx int) string {
+	return cache.Key(e.profile(), e.overlaybdLayers[idx].chainID)
+}
+
 // If manifest is already converted, avoid conversion. (e.g During tag reuse or cross repo mounts)
 // Note: This is output mediatype sensitive, if the manifest is converted to a different mediatype,
 // we will still convert it normally.
 func (e *overlaybdBuilderEngine) CheckForConvertedManifest(ctx context.Context) (specs.Descriptor, error) {
-	if e.db == nil {
+	// the acceleration layer is not part of the manifest record, so the result can't be reused
+	if e.db == nil || e.accelLayerFile != "" {
 		return specs.Descriptor{}, errdefs.ErrNotFound
 	}
 
@@ -289,10 +354,10 @@ func (e *overlaybdBuilderEngine) CheckForConvertedManifest(ctx context.Context)
 		rc, err := e.fetcher.Fetch(ctx, convertedDesc)
 		if err == nil {
 			rc.Close()
-			logrus.Infof("manifest %s found in remote with resulting digest %s", e.inputDesc.Digest, convertedDesc.Digest)
+			log.G(ctx).Infof("manifest %s found in remote with resulting digest %s", e.inputDesc.Digest, convertedDesc.Digest)
 			return convertedDesc, nil
 		}
-		if errdefs.IsNotFound(err) {
+		if errdefs.IsNotFound(err) && !e.dryRun {
 			// invalid record in db, which is not found in registry, remove it
 			err := e.db.DeleteManifestEntry(ctx, e.host, e.repository, e.mediaTypeManifest(), e.inputDesc.Digest)
 			if err != nil {
@@ -314,7 +379,7 @@ func (e *overlaybdBuilderEngine) CheckForConvertedManifest(ctx context.Context)
 		}
 		manifest, err := fetchManifest(ctx, fetcher, convertedDesc)
 		if err != nil {
-			if errdefs.IsNotFound(err) {
+			if errdefs.IsNotFound(err) && !e.dryRun {
 				// invalid record in db, which is not found in registry, remove it
 				err := e.db.DeleteManifestEntry(ctx, entry.Host, entry.Repository, e.mediaTypeManifest(), e.inputDesc.Digest)
 				if err != nil {
@@ -323,31 +388,50 @@ func (e *overlaybdBuilderEngine) CheckForConvertedManifest(ctx context.Context)
 			}
 			continue
 		}
+		if e.dryRun {
+			// the manifest would be mounted from the other repo
+			log.G(ctx).Infof("manifest %s found in %s", convertedDesc.Digest, entry.Repository)
+			return convertedDesc, nil
+		}
 		if err := e.mountImage(ctx, *manifest, convertedDesc, entry.Repository); err != nil {
 			continue // try a different repo if available
 		}
 		if err := e.db.CreateManifestEntry(ctx, e.host, e.repository, e.mediaTypeManifest(), e.inputDesc.Digest, convertedDesc.Digest, entry.DataSize); err != nil {
 			continue // try a different repo if available
 		}
-		logrus.Infof("manifest %s mount from %s was successful", convertedDesc.Digest, entry.Repository)
+		log.G(ctx).Infof("manifest %s mount from %s was successful", convertedDesc.Digest, entry.Repository)
 		return convertedDesc, nil
 	}
 
-	logrus.Infof("manifest %s not found already converted in remote", e.inputDesc.Digest)
+	log.G(ctx).Infof("manifest %s not found already converted in remote", e.inputDesc.Digest)
 	return specs.Descriptor{}, errdefs.ErrNotFound
 }
 
+// blobExists checks if desc is present in repository of the target registry
+func (e *overlaybdBuilderEngine) blobExists(ctx context.Context, repository string, desc specs.Descriptor) bool {
+	fetcher, err := e.resolver.Fetcher(ctx, fmt.Sprintf("%s/%s@%s", e.host, repository, desc.Digest))
+	if err != nil {
+		return false
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return false
+	}
+	rc.Close()
+	return true
+}
+
 // mountImage is responsible for mounting a specific manifest from a source repository, this includes
 // mounting all layers + config and then pushing the manifest.
 func (e *overlaybdBuilderEngine) mountImage(ctx context.Context, manifest specs.Manifest, desc specs.Descriptor, mountRepository string) error {
 	// Mount Config Blobs
 	config := manifest.Config
 	config.Annotations = map[string]string{
-		fmt.Sprintf("%s.%s", labelDistributionSource, e.host): mountRepository,
+		distributionSourceLabel(e.host): mountRepository,
 	}
 	_, err := e.pusher.Push(ctx, config)
 	if errdefs.IsAlreadyExists(err) {
-		logrus.Infof("config blob mount from %s was successful", mountRepository)
+		log.G(ctx).Infof("config blob mount from %s was successful", mountRepository)
 	} else if err != nil {
 		return fmt.Errorf("Failed to mount config blob from %s repository : %w", mountRepository, err)
 	}
@@ -356,11 +440,11 @@ func (e *overlaybdBuilderEngine) mountImage(ctx context.Context, manifest specs.
 	for idx, layer := range manifest.Layers {
 		desc := layer
 		desc.Annotations = map[string]string{
-			fmt.Sprintf("%s.%s", labelDistributionSource, e.host): mountRepository,
+			distributionSourceLabel(e.host): mountRepository,
 		}
 		_, err := e.pusher.Push(ctx, desc)
 		if errdefs.IsAlreadyExists(err) {
-			logrus.Infof("layer %d mount from %s was successful", idx, mountRepository)
+			log.G(ctx).Infof("layer %d mount from %s was successful", idx, mountRepository)
 		} else if err != nil {
 			return fmt.Errorf("failed to mount all layers from %s repository : %w", mountRepository, err)
 		}
@@ -375,7 +459,7 @@ func (e *overlaybdBuilderEngine) mountImage(ctx context.Context, manifest specs.
 }
 
 func (e *overlaybdBuilderEngine) StoreConvertedManifestDetails(ctx context.Context) error {
-	if e.db == nil {
+	if e.db == nil || e.accelLayerFile != "" {
 		return nil
 	}
 	if e.outputDesc.Digest == "" {
@@ -385,19 +469,37 @@ func (e *overlaybdBuilderEngine) StoreConvertedManifestDetails(ctx context.Conte
 }
 
 func (e *overlaybdBuilderEngine) StoreConvertedLayerDetails(ctx context.Context, idx int) error {
+	if e.cache != nil && !e.overlaybdLayers[idx].fromCache {
+		if err := e.cache.Store(ctx, e.cacheKey(idx), path.Join(e.getLayerDir(idx), commitFile)); err != nil {
+			log.G(ctx).Warnf("failed to store layer %d in cache: %v", idx, err)
+		}
+	}
 	if e.db == nil {
 		return nil
 	}
-	if e.overlaybdLayers[idx].fromDedup {
-		logrus.Infof("layer %d skip storing conversion details", idx)
+	// the layer restored from cache has been uploaded like a converted one
+	if e.overlaybdLayers[idx].fromDedup && !e.overlaybdLayers[idx].fromCache {
+		log.G(ctx).Infof("layer %d skip storing conversion details", idx)
 		return nil
 	}
-	return e.db.CreateLayerEntry(ctx, e.host, e.repository, e.overlaybdLayers[idx].desc.Digest, e.overlaybdLayers[idx].chainID, e.overlaybdLayers[idx].desc.Size)
+	err := e.db.CreateLayerEntry(ctx, e.host, e.repository, e.overlaybdLayers[idx].desc.Digest, e.overlaybdLayers[idx].chainID, e.overlaybdLayers[idx].desc.Size)
+	if e.leases != nil {
+		// the entry is visible to the waiting workers now
+		e.leases.Release(ctx, e.overlaybdLayers[idx].chainID, e.profile())
+	}
+	return err
 }
 
 func (e *overlaybdBuilderEngine) DownloadConvertedLayer(ctx context.Context, idx int, desc specs.Descriptor) error {
 	targetFile := path.Join(e.getLayerDir(idx), commitFile)
-	err := downloadLayer(ctx, e.fetcher, targetFile, desc, true)
+	var err error
+	if e.overlaybdLayers[idx].fromCache {
+		if err = e.cache.Restore(ctx, e.cacheKey(idx), e.getLayerDir(idx)); err != nil {
+			e.overlaybdLayers[idx].fromCache = false
+		}
+	} else {
+		err = downloadLayer(ctx, e.fetcher, targetFile, desc, true)
+	}
 	if err != nil {
 		// We should remove the commit file if the download failed to allow for fallback conversion
 		os.Remove(targetFile) // Remove any file that may have failed to download
@@ -410,6 +512,9 @@ func (e *overlaybdBuilderEngine) DownloadConvertedLayer(ctx context.Context, idx
 }
 
 func (e *overlaybdBuilderEngine) Cleanup() {
+	if e.leases != nil {
+		e.leases.ReleaseAll(context.Background())
+	}
 	if !e.reserve {
 		os.RemoveAll(e.workDir)
 	}
@@ -464,7 +569,7 @@ func (e *overlaybdBuilderEngine) uploadBaseLayer(ctx context.Context) (specs.Des
 		if err = uploadBlob(ctx, e.pusher, tarFile, baseDesc); err != nil {
 			return specs.Descriptor{}, errors.Wrapf(err, "failed to upload baselayer")
 		}
-		logrus.Infof("baselayer uploaded")
+		log.G(ctx).Infof("baselayer uploaded")
 	}
 	return baseDesc, nil
 }
@@ -480,7 +585,7 @@ func (e *overlaybdBuilderEngine) create(ctx context.Context, dir string, mkfs bo
 	}
 	if mkfs {
 		opts = append(opts, "--mkfs")
-		logrus.Infof("mkfs for baselayer, vsize: %d GB", vsizeGB)
+		log.G(ctx).Infof("mkfs for baselayer, vsize: %d GB", vsizeGB)
 	}
 	return utils.Create(ctx, dir, opts...)
 }
@@ -501,10 +606,16 @@ func (e *overlaybdBuilderEngine) commit(ctx context.Context, dir string, idx int
 	if parentUUID != "" {
 		opts = append(opts, "--parent-uuid", parentUUID)
 	}
+	if e.zfileAlgorithm != "" {
+		opts = append(opts, "--algorithm", e.zfileAlgorithm)
+	}
+	if e.zfileBlockSize != 0 {
+		opts = append(opts, "--bs", strconv.Itoa(e.zfileBlockSize))
+	}
 	if err := utils.Commit(ctx, dir, dir, false, opts...); err != nil {
 		return err
 	}
-	logrus.Infof("layer %d committed, uuid: %s, parent uuid: %s", idx, curUUID, parentUUID)
+	log.G(ctx).Infof("layer %d committed, uuid: %s, parent uuid: %s", idx, curUUID, parentUUID)
 	return nil
 }
 
@@ -524,3 +635,12 @@ func chainIDtoUUID(chainID string) string {
 	dStr := chainID[7:]
 	return fmt.Sprintf("%s-%s-%s-%s-%s", dStr[0:8], dStr[8:12], dStr[12:16], dStr[16:20], dStr[20:32])
 }
+
+// distributionSourceLabel returns the annotation of the repositories a blob can
+// be mounted from. Like containerd, it's keyed by the registry host without port.
+func distributionSourceLabel(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return fmt.Sprintf("%s.%s", labelDistributionSource, host)
+}
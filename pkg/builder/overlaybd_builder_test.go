@@ -17,15 +17,21 @@
 package builder
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
-	testingresources "github.com/containerd/accelerated-container-image/cmd/convertor/testingresources"
+	"github.com/containerd/accelerated-container-image/pkg/builder/cache"
+	testingresources "github.com/containerd/accelerated-container-image/pkg/builder/testingresources"
+	"github.com/containerd/accelerated-container-image/pkg/database"
 	sn "github.com/containerd/accelerated-container-image/pkg/types"
+	"github.com/containerd/accelerated-container-image/pkg/utils/faketools"
 	"github.com/containerd/errdefs"
 
 	"github.com/containerd/containerd/v2/core/images"
@@ -540,3 +546,215 @@ func Test_overlaybd_builder_UploadLayer(t *testing.T) {
 		}
 	})
 }
+
+func Test_overlaybd_builder_LocalCache(t *testing.T) {
+	ctx := context.Background()
+	layerDesc := v1.Descriptor{
+		Digest:    testingresources.DockerV2_Manifest_Simple_Layer_0_Digest,
+		Size:      testingresources.DockerV2_Manifest_Simple_Layer_0_Size,
+		MediaType: v1.MediaTypeImageLayerGzip,
+	}
+	c, err := cache.New(filepath.Join(t.TempDir(), "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEngine := func(t *testing.T) *overlaybdBuilderEngine {
+		base := &builderEngineBase{
+			host:       "sample.localstore.io",
+			repository: "hello-world",
+			workDir:    t.TempDir(),
+			cache:      c,
+		}
+		base.manifest.Layers = []v1.Descriptor{layerDesc}
+		return &overlaybdBuilderEngine{
+			builderEngineBase: base,
+			overlaybdConfig:   &sn.OverlayBDBSConfig{},
+			overlaybdLayers: []overlaybdConvertResult{
+				{
+					chainID: "fake-chain-id",
+				},
+			},
+		}
+	}
+	commitData := []byte("fake commit file")
+
+	t.Run("Converted layer is stored in cache", func(t *testing.T) {
+		e := newEngine(t)
+		_, err := e.CheckForConvertedLayer(ctx, 0)
+		testingresources.Assert(t, errdefs.IsNotFound(err), fmt.Sprintf("CheckForConvertedLayer() returned an unexpected Error: %v", err))
+
+		if err := os.MkdirAll(e.getLayerDir(0), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(e.getLayerDir(0), commitFile), commitData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.StoreConvertedLayerDetails(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Cached layer is restored", func(t *testing.T) {
+		e := newEngine(t)
+		desc, err := e.CheckForConvertedLayer(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testingresources.Assert(t, desc.Digest == digest.FromBytes(commitData), "CheckForConvertedLayer() returned incorrect digest")
+		testingresources.Assert(t, desc.Size == int64(len(commitData)), "CheckForConvertedLayer() returned improper size layer")
+
+		if err := e.DownloadConvertedLayer(ctx, 0, desc); err != nil {
+			t.Fatal(err)
+		}
+		testingresources.Assert(t, e.overlaybdLayers[0].fromDedup, "DownloadConvertedLayer() did not mark layer as dedup")
+		if err := e.BuildLayer(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(path.Join(e.getLayerDir(0), commitFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testingresources.Assert(t, string(got) == string(commitData), "restored commit file has unexpected content")
+	})
+
+	t.Run("Profile is part of the key", func(t *testing.T) {
+		e := newEngine(t)
+		e.mkfs = true
+		_, err := e.CheckForConvertedLayer(ctx, 0)
+		testingresources.Assert(t, errdefs.IsNotFound(err), fmt.Sprintf("CheckForConvertedLayer() returned an unexpected Error: %v", err))
+	})
+}
+
+func Test_overlaybd_builder_LayerLease(t *testing.T) {
+	ctx := context.Background()
+	db := testingresources.NewLocalDB()
+	resolver := testingresources.GetTestResolver(t, ctx)
+	fetcher := testingresources.GetTestFetcherFromResolver(t, ctx, resolver, testingresources.DockerV2_Manifest_Simple_Ref)
+	targetDesc := v1.Descriptor{
+		Digest:    testingresources.DockerV2_Manifest_Simple_Layer_0_Digest,
+		Size:      testingresources.DockerV2_Manifest_Simple_Layer_0_Size,
+		MediaType: v1.MediaTypeImageLayerGzip,
+	}
+	fakeChainId := "fake-chain-id"
+	newEngine := func() *overlaybdBuilderEngine {
+		base := &builderEngineBase{
+			fetcher:    fetcher,
+			db:         db,
+			host:       "sample.localstore.io",
+			repository: "hello-world",
+		}
+		base.leases = database.NewLayerLeases(db, base.host)
+		base.leases.Poll = 10 * time.Millisecond
+		return &overlaybdBuilderEngine{
+			builderEngineBase: base,
+			overlaybdLayers: []overlaybdConvertResult{
+				{
+					chainID: fakeChainId,
+				},
+			},
+		}
+	}
+
+	t.Run("Waits for the lease holder", func(t *testing.T) {
+		holder := newEngine()
+		_, err := holder.CheckForConvertedLayer(ctx, 0)
+		testingresources.Assert(t, errdefs.IsNotFound(err), fmt.Sprintf("CheckForConvertedLayer() returned an unexpected Error: %v", err))
+
+		waiter := newEngine()
+		type result struct {
+			desc v1.Descriptor
+			err  error
+		}
+		done := make(chan result)
+		go func() {
+			desc, err := waiter.CheckForConvertedLayer(ctx, 0)
+			done <- result{desc, err}
+		}()
+		select {
+		case r := <-done:
+			t.Fatalf("CheckForConvertedLayer() returned while the layer is leased: %v", r.err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		holder.overlaybdLayers[0].desc = targetDesc
+		if err := holder.StoreConvertedLayerDetails(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+		r := <-done
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		testingresources.Assert(t, r.desc.Digest == targetDesc.Digest, "CheckForConvertedLayer() returned incorrect digest")
+		holder.Cleanup()
+		waiter.Cleanup()
+	})
+
+	t.Run("Expired lease is reclaimed", func(t *testing.T) {
+		fakeChainId = "another-fake-chain-id"
+		crashed := newEngine()
+		ok, err := db.AcquireLayerLease(ctx, crashed.host, fakeChainId, crashed.profile(), crashed.leases.Owner, 10*time.Millisecond)
+		testingresources.Assert(t, ok && err == nil, fmt.Sprintf("AcquireLayerLease() failed: %v", err))
+
+		e := newEngine()
+		ok, err = db.AcquireLayerLease(ctx, e.host, fakeChainId, e.profile(), e.leases.Owner, time.Minute)
+		testingresources.Assert(t, !ok && err == nil, "AcquireLayerLease() took a lease held by another owner")
+
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		_, err = e.CheckForConvertedLayer(ctx, 0)
+		testingresources.Assert(t, errdefs.IsNotFound(err), fmt.Sprintf("CheckForConvertedLayer() returned an unexpected Error: %v", err))
+		e.Cleanup()
+	})
+}
+
+func Test_overlaybd_builder_ZFileOptions(t *testing.T) {
+	ctx := context.Background()
+	resolver := testingresources.GetTestResolver(t, ctx)
+	b, err := NewBuilder(BuilderOptions{
+		Ref:             testingresources.DockerV2_Manifest_Simple_Ref,
+		TargetRef:       "sample.localstore.io/hello-world:zfile",
+		WorkDir:         t.TempDir(),
+		Engine:          Overlaybd,
+		Mkfs:            true,
+		Vsize:           64,
+		Resolver:        resolver,
+		OverlayBDBinDir: faketools.Install(t),
+		ZFileAlgorithm:  "zstd",
+		ZFileBlockSize:  16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, desc, err := resolver.Resolve(ctx, "sample.localstore.io/hello-world:zfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := testingresources.GetTestFetcherFromResolver(t, ctx, resolver, "sample.localstore.io/hello-world:zfile")
+	manifest, _, err := fetchManifestAndConfig(ctx, fetcher, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := fetcher.Fetch(ctx, manifest.Layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	header, err := bufio.NewReader(rc).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	testingresources.Assert(t, strings.Contains(header, "--algorithm zstd --bs 16"), fmt.Sprintf("zfile options aren't passed to commit: %q", header))
+
+	e := &overlaybdBuilderEngine{builderEngineBase: &builderEngineBase{mkfs: true, vsize: 64}}
+	profile := e.profile()
+	e.zfileAlgorithm = "zstd"
+	testingresources.Assert(t, e.profile() != profile, "zfile options don't change the profile")
+
+	for _, opt := range []BuilderOptions{{ZFileAlgorithm: "gzip"}, {ZFileBlockSize: 12}} {
+		_, err := NewBuilder(opt)
+		testingresources.Assert(t, err != nil, fmt.Sprintf("invalid zfile options %q/%d are accepted", opt.ZFileAlgorithm, opt.ZFileBlockSize))
+	}
+}
@@ -0,0 +1,254 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package prefetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"debug/elf"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/log"
+)
+
+const (
+	ldSoConf    = "/etc/ld.so.conf"
+	ldMuslGlob  = "/etc/ld-musl-*.path"
+	maxLdIncDep = 8
+)
+
+// multiarch library dirs used by debian based images
+var multiarchTriplets = map[elf.Machine]string{
+	elf.EM_X86_64:  "x86_64-linux-gnu",
+	elf.EM_386:     "i386-linux-gnu",
+	elf.EM_AARCH64: "aarch64-linux-gnu",
+	elf.EM_ARM:     "arm-linux-gnueabihf",
+	elf.EM_PPC64:   "powerpc64le-linux-gnu",
+	elf.EM_S390:    "s390x-linux-gnu",
+	elf.EM_RISCV:   "riscv64-linux-gnu",
+}
+
+// analyzeFile returns the dependencies of an executable, a shared library or a
+// script. Other files are ignored.
+func (a *Analyzer) analyzeFile(ctx context.Context, p string, args []string) ([]task, error) {
+	local, ok := a.extracted[p]
+	if !ok {
+		return nil, nil
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return nil, nil
+	}
+	switch {
+	case bytes.Equal(magic, []byte(elf.ELFMAG)):
+		ef, err := elf.NewFile(f)
+		if err != nil {
+			log.G(ctx).Debugf("prefetch: %s is not a valid elf: %v", p, err)
+			return nil, nil
+		}
+		defer ef.Close()
+		return a.elfDeps(ctx, p, ef), nil
+	case bytes.HasPrefix(magic, []byte("#!")):
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		line, _ := bufio.NewReader(f).ReadString('\n')
+		return a.scriptDeps(p, line, args), nil
+	}
+	return nil, nil
+}
+
+// elfDeps returns the interpreter and the DT_NEEDED libraries of an elf file,
+// searched in the same order as ld.so(8).
+func (a *Analyzer) elfDeps(ctx context.Context, p string, ef *elf.File) []task {
+	var deps []task
+	for _, prog := range ef.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		buf, err := io.ReadAll(prog.Open())
+		if err != nil {
+			continue
+		}
+		if interp, ok := a.resolveFile(strings.TrimRight(string(buf), "\x00")); ok {
+			deps = append(deps, a.file(interp)...)
+		}
+	}
+
+	libs, err := ef.ImportedLibraries()
+	if err != nil {
+		// statically linked
+		return deps
+	}
+	origin := path.Dir(p)
+	expand := func(dirs []string) []string {
+		var result []string
+		for _, d := range dirs {
+			for _, dd := range strings.Split(d, ":") {
+				dd = strings.ReplaceAll(dd, "${ORIGIN}", origin)
+				dd = strings.ReplaceAll(dd, "$ORIGIN", origin)
+				if dd != "" {
+					result = append(result, dd)
+				}
+			}
+		}
+		return result
+	}
+	runpath, _ := ef.DynString(elf.DT_RUNPATH)
+	var searchDirs []string
+	if len(runpath) == 0 {
+		rpath, _ := ef.DynString(elf.DT_RPATH)
+		searchDirs = append(searchDirs, expand(rpath)...)
+	}
+	searchDirs = append(searchDirs, expand([]string{a.getEnv("LD_LIBRARY_PATH", "")})...)
+	searchDirs = append(searchDirs, expand(runpath)...)
+	searchDirs = append(searchDirs, a.ldConfDirs...)
+	searchDirs = append(searchDirs, defaultLibDirs(ef)...)
+
+	for _, lib := range libs {
+		found := false
+		if strings.Contains(lib, "/") {
+			if r, ok := a.resolveFile(lib); ok {
+				deps = append(deps, a.file(r)...)
+				found = true
+			}
+		} else {
+			for _, dir := range searchDirs {
+				if r, ok := a.resolveFile(path.Join(dir, lib)); ok {
+					deps = append(deps, a.file(r)...)
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			log.G(ctx).Debugf("prefetch: library %s needed by %s not found", lib, p)
+		}
+	}
+	return deps
+}
+
+func defaultLibDirs(ef *elf.File) []string {
+	var dirs []string
+	if triplet, ok := multiarchTriplets[ef.Machine]; ok {
+		dirs = append(dirs, "/lib/"+triplet, "/usr/lib/"+triplet)
+	}
+	if ef.Class == elf.ELFCLASS64 {
+		dirs = append(dirs, "/lib64", "/usr/lib64")
+	}
+	return append(dirs, "/lib", "/usr/lib", "/usr/local/lib")
+}
+
+// file returns an analyze task for a resolved file not yet in the list
+func (a *Analyzer) file(p string) []task {
+	if !a.add(p) {
+		return nil
+	}
+	return []task{{kind: taskFile, path: p}}
+}
+
+// scriptDeps handles the shebang line of a script, including `#!/usr/bin/env cmd`
+func (a *Analyzer) scriptDeps(p, line string, args []string) []task {
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), "#!"))
+	if len(fields) == 0 {
+		return nil
+	}
+	interpArgs := func(opts []string) []string {
+		return append(append(append([]string{}, opts...), p), args...)
+	}
+	if path.Base(fields[0]) == "env" {
+		var deps []task
+		if r, ok := a.resolveFile(fields[0]); ok {
+			deps = append(deps, a.file(r)...)
+		}
+		for i, f := range fields[1:] {
+			if strings.HasPrefix(f, "-") || strings.Contains(f, "=") {
+				continue
+			}
+			return append(deps, task{kind: taskExec, path: f, args: interpArgs(fields[i+2:])})
+		}
+		return deps
+	}
+	return []task{{kind: taskExec, path: fields[0], args: interpArgs(fields[1:])}}
+}
+
+// loadLdConf collects library dirs from /etc/ld.so.conf (with includes) and
+// the musl path file.
+func (a *Analyzer) loadLdConf(ctx context.Context) error {
+	confs := a.glob(ldMuslGlob)
+	if r, ok := a.resolveFile(ldSoConf); ok {
+		confs = append(confs, r)
+	}
+	seen := make(map[string]bool)
+	for depth := 0; len(confs) > 0 && depth < maxLdIncDep; depth++ {
+		var resolved []string
+		for _, c := range confs {
+			if r, ok := a.resolveFile(c); ok && !seen[r] {
+				seen[r] = true
+				resolved = append(resolved, r)
+			}
+		}
+		if err := a.extract(ctx, resolved); err != nil {
+			return err
+		}
+		var includes []string
+		for _, c := range resolved {
+			data, err := a.readFile(ctx, c)
+			if err != nil {
+				continue
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				if i := strings.IndexByte(line, '#'); i >= 0 {
+					line = line[:i]
+				}
+				fields := strings.Fields(line)
+				if len(fields) == 0 {
+					continue
+				}
+				if fields[0] == "include" {
+					for _, pattern := range fields[1:] {
+						if !path.IsAbs(pattern) {
+							pattern = path.Join(path.Dir(c), pattern)
+						}
+						includes = append(includes, a.glob(pattern)...)
+					}
+					continue
+				}
+				// musl path files may separate dirs with ':'
+				for _, f := range fields {
+					for _, dir := range strings.Split(f, ":") {
+						if path.IsAbs(dir) {
+							a.ldConfDirs = append(a.ldConfDirs, path.Clean(dir))
+						}
+					}
+				}
+			}
+		}
+		confs = includes
+	}
+	return nil
+}
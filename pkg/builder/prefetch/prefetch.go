@@ -0,0 +1,463 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package prefetch generates a priority list for an image without running it.
+//
+// The entrypoint of the image is resolved inside the layer tars, and its
+// dependencies (ELF interpreter and DT_NEEDED libraries, script interpreters and
+// some well-known runtime files) are followed recursively. The result can be used
+// by `ctr record-trace --priority_list` or as the acceleration layer of the
+// userspace convertor.
+package prefetch
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/log"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// same limit as linux
+	maxSymlinks = 40
+
+	defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+type fileEntry struct {
+	layer    int
+	typ      byte
+	linkname string
+	size     int64
+}
+
+// Analyzer holds a merged view of the image filesystem and the files already
+// collected in the priority list.
+type Analyzer struct {
+	fetcher remotes.Fetcher
+	layers  []specs.Descriptor
+	config  specs.ImageConfig
+	workDir string
+
+	index     map[string]*fileEntry
+	extracted map[string]string // image path -> local path
+	seen      map[string]bool
+	list      []string
+
+	// library search dirs from /etc/ld.so.conf and /etc/ld-musl-*.path
+	ldConfDirs []string
+}
+
+// NewAnalyzer creates an analyzer for the image described by manifest and config.
+// workDir is used to extract the files needing inspection.
+func NewAnalyzer(fetcher remotes.Fetcher, manifest specs.Manifest, config specs.Image, workDir string) *Analyzer {
+	return &Analyzer{
+		fetcher:   fetcher,
+		layers:    manifest.Layers,
+		config:    config.Config,
+		workDir:   workDir,
+		index:     make(map[string]*fileEntry),
+		extracted: make(map[string]string),
+		seen:      make(map[string]bool),
+	}
+}
+
+// GeneratePriorityList returns the files needed to start the image entrypoint,
+// in the order they are discovered.
+func GeneratePriorityList(ctx context.Context, fetcher remotes.Fetcher, manifest specs.Manifest, config specs.Image, workDir string) ([]string, error) {
+	a := NewAnalyzer(fetcher, manifest, config, workDir)
+	defer os.RemoveAll(workDir)
+	return a.Analyze(ctx)
+}
+
+// WritePriorityList writes list to file, one path per line.
+func WritePriorityList(file string, list []string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, p := range list {
+		if _, err := fmt.Fprintln(w, p); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Analyze builds the file index of the image, then follows the entrypoint.
+func (a *Analyzer) Analyze(ctx context.Context) ([]string, error) {
+	if err := a.buildIndex(ctx); err != nil {
+		return nil, err
+	}
+	args := append(append([]string{}, a.config.Entrypoint...), a.config.Cmd...)
+	if len(args) == 0 {
+		return nil, errors.New("image has neither entrypoint nor cmd")
+	}
+	if err := a.loadLdConf(ctx); err != nil {
+		return nil, err
+	}
+
+	queue := []task{{kind: taskExec, path: args[0], args: args[1:]}}
+	for len(queue) > 0 {
+		// extract every file of this round at once to reduce layer fetches
+		var files []string
+		for _, t := range queue {
+			if t.kind != taskFile {
+				continue
+			}
+			files = append(files, t.path)
+		}
+		if err := a.extract(ctx, files); err != nil {
+			return nil, err
+		}
+		var next []task
+		for _, t := range queue {
+			deps, err := a.process(ctx, t)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, deps...)
+		}
+		queue = next
+	}
+	return a.list, nil
+}
+
+type taskKind int
+
+const (
+	// taskExec resolves a command like execve(2) would, then analyzes it
+	taskExec taskKind = iota
+	// taskFile analyzes a resolved file as an executable or a shared library
+	taskFile
+	// taskInclude adds a resolved file to the list without analyzing it
+	taskInclude
+)
+
+type task struct {
+	kind taskKind
+	path string
+	args []string
+}
+
+func (a *Analyzer) process(ctx context.Context, t task) ([]task, error) {
+	switch t.kind {
+	case taskExec:
+		p, ok := a.lookPath(t.path)
+		if !ok {
+			log.G(ctx).Warnf("prefetch: command %q not found in image", t.path)
+			return nil, nil
+		}
+		var deps []task
+		if a.add(p) {
+			deps = append(deps, task{kind: taskFile, path: p, args: t.args})
+		}
+		// runtime heuristics are based on the command name and its arguments
+		deps = append(deps, a.runtimeFiles(p, t.args)...)
+		return deps, nil
+	case taskFile:
+		return a.analyzeFile(ctx, t.path, t.args)
+	case taskInclude:
+		a.add(t.path)
+	}
+	return nil, nil
+}
+
+// add appends a resolved path to the list, returns false if already present
+func (a *Analyzer) add(p string) bool {
+	if a.seen[p] {
+		return false
+	}
+	a.seen[p] = true
+	a.list = append(a.list, p)
+	return true
+}
+
+// include returns an include task for p if it resolves to a regular file
+func (a *Analyzer) include(p string) []task {
+	if r, ok := a.resolveFile(p); ok {
+		return []task{{kind: taskInclude, path: r}}
+	}
+	return nil
+}
+
+// lookPath resolves a command name like execvp(3) with PATH from the image env
+func (a *Analyzer) lookPath(name string) (string, bool) {
+	if strings.Contains(name, "/") {
+		if !path.IsAbs(name) {
+			name = path.Join(a.workingDir(), name)
+		}
+		return a.resolveFile(name)
+	}
+	for _, dir := range strings.Split(a.getEnv("PATH", defaultPath), ":") {
+		if dir == "" {
+			continue
+		}
+		if p, ok := a.resolveFile(path.Join(dir, name)); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func (a *Analyzer) workingDir() string {
+	if a.config.WorkingDir == "" {
+		return "/"
+	}
+	return a.config.WorkingDir
+}
+
+func (a *Analyzer) getEnv(key, def string) string {
+	for _, kv := range a.config.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok && k == key {
+			return v
+		}
+	}
+	return def
+}
+
+// -------------------- file index --------------------
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// buildIndex walks all layer tars and merges them, applying whiteouts.
+func (a *Analyzer) buildIndex(ctx context.Context) error {
+	for idx := range a.layers {
+		if err := a.walkLayer(ctx, idx, func(hdr *tar.Header, _ io.Reader) error {
+			name := cleanPath(hdr.Name)
+			dir, base := path.Split(name)
+			if base == whiteoutOpaque {
+				a.removeChildren(path.Clean(dir), idx)
+				return nil
+			}
+			if strings.HasPrefix(base, whiteoutPrefix) {
+				target := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+				delete(a.index, target)
+				a.removeChildren(target, idx)
+				return nil
+			}
+			entry := &fileEntry{
+				layer: idx,
+				typ:   hdr.Typeflag,
+				size:  hdr.Size,
+			}
+			if hdr.Typeflag == tar.TypeSymlink {
+				entry.linkname = hdr.Linkname
+			} else if hdr.Typeflag == tar.TypeLink {
+				entry.linkname = cleanPath(hdr.Linkname)
+			}
+			a.index[name] = entry
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "failed to index layer %d", idx)
+		}
+	}
+	log.G(ctx).Debugf("prefetch: %d entries indexed", len(a.index))
+	return nil
+}
+
+// removeChildren removes entries under dir that come from layers below idx
+func (a *Analyzer) removeChildren(dir string, idx int) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for p, e := range a.index {
+		if e.layer < idx && strings.HasPrefix(p, prefix) {
+			delete(a.index, p)
+		}
+	}
+}
+
+func (a *Analyzer) walkLayer(ctx context.Context, idx int, fn func(hdr *tar.Header, r io.Reader) error) error {
+	rc, err := a.fetcher.Fetch(ctx, a.layers[idx])
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	drc, err := compression.DecompressStream(rc)
+	if err != nil {
+		return err
+	}
+	defer drc.Close()
+	tr := tar.NewReader(drc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// resolve follows symlinks in every component of p. Directories missing from
+// the index are accepted since layer tars don't always contain them.
+func (a *Analyzer) resolve(p string, depth int) (string, *fileEntry, bool) {
+	if depth > maxSymlinks {
+		return "", nil, false
+	}
+	parts := strings.Split(strings.TrimPrefix(cleanPath(p), "/"), "/")
+	cur := "/"
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		next := path.Join(cur, part)
+		entry, ok := a.index[next]
+		if !ok {
+			if i == len(parts)-1 {
+				return "", nil, false
+			}
+			cur = next
+			continue
+		}
+		if entry.typ == tar.TypeSymlink {
+			target := entry.linkname
+			if !path.IsAbs(target) {
+				target = path.Join(cur, target)
+			}
+			return a.resolve(path.Join(append([]string{target}, parts[i+1:]...)...), depth+1)
+		}
+		if i == len(parts)-1 {
+			return next, entry, true
+		}
+		cur = next
+	}
+	return cur, a.index[cur], true
+}
+
+// resolveFile resolves p to a regular file (or a hard link to one)
+func (a *Analyzer) resolveFile(p string) (string, bool) {
+	r, entry, ok := a.resolve(p, 0)
+	if !ok || entry == nil {
+		return "", false
+	}
+	switch entry.typ {
+	case tar.TypeReg, tar.TypeLink:
+		return r, true
+	}
+	return "", false
+}
+
+// glob returns the regular files in the index matching pattern, see path.Match
+func (a *Analyzer) glob(pattern string) []string {
+	var matches []string
+	for p, e := range a.index {
+		if e.typ != tar.TypeReg && e.typ != tar.TypeLink {
+			continue
+		}
+		if ok, _ := path.Match(pattern, p); ok {
+			matches = append(matches, p)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// extract copies the content of files into workDir, fetching each layer at most once
+func (a *Analyzer) extract(ctx context.Context, files []string) error {
+	byLayer := make(map[int]map[string][]string) // layer -> name in layer -> image paths
+	for _, p := range files {
+		if _, ok := a.extracted[p]; ok {
+			continue
+		}
+		entry, ok := a.index[p]
+		if !ok {
+			continue
+		}
+		name := p
+		// content of a hard link is stored with its target
+		if entry.typ == tar.TypeLink {
+			target, ok := a.index[entry.linkname]
+			if !ok {
+				continue
+			}
+			name, entry = entry.linkname, target
+		}
+		if byLayer[entry.layer] == nil {
+			byLayer[entry.layer] = make(map[string][]string)
+		}
+		byLayer[entry.layer][name] = append(byLayer[entry.layer][name], p)
+	}
+	for idx, names := range byLayer {
+		if err := a.walkLayer(ctx, idx, func(hdr *tar.Header, r io.Reader) error {
+			paths, ok := names[cleanPath(hdr.Name)]
+			if !ok || hdr.Typeflag != tar.TypeReg {
+				return nil
+			}
+			local := filepath.Join(a.workDir, fmt.Sprintf("%d", len(a.extracted)))
+			if err := writeFile(local, r); err != nil {
+				return err
+			}
+			for _, p := range paths {
+				a.extracted[p] = local
+			}
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "failed to extract files from layer %d", idx)
+		}
+	}
+	return nil
+}
+
+func writeFile(file string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// readFile returns the content of an image file, extracting it if necessary
+func (a *Analyzer) readFile(ctx context.Context, p string) ([]byte, error) {
+	if err := a.extract(ctx, []string{p}); err != nil {
+		return nil, err
+	}
+	local, ok := a.extracted[p]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return os.ReadFile(local)
+}
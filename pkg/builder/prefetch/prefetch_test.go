@@ -0,0 +1,286 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package prefetch
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"debug/elf"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type entry struct {
+	name     string
+	typ      byte
+	linkname string
+	content  string
+}
+
+func reg(name, content string) entry { return entry{name: name, typ: tar.TypeReg, content: content} }
+func sym(name, target string) entry  { return entry{name: name, typ: tar.TypeSymlink, linkname: target} }
+func dir(name string) entry          { return entry{name: name, typ: tar.TypeDir} }
+
+type fakeFetcher map[digest.Digest][]byte
+
+func (f fakeFetcher) Fetch(ctx context.Context, desc specs.Descriptor) (io.ReadCloser, error) {
+	data, ok := f[desc.Digest]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func buildImage(t *testing.T, layers ...[]entry) (fakeFetcher, specs.Manifest) {
+	fetcher := make(fakeFetcher)
+	var manifest specs.Manifest
+	for _, layer := range layers {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		for _, e := range layer {
+			hdr := &tar.Header{
+				Name:     e.name,
+				Typeflag: e.typ,
+				Linkname: e.linkname,
+				Mode:     0755,
+				Size:     int64(len(e.content)),
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dgst := digest.FromBytes(buf.Bytes())
+		fetcher[dgst] = buf.Bytes()
+		manifest.Layers = append(manifest.Layers, specs.Descriptor{
+			MediaType: specs.MediaTypeImageLayer,
+			Digest:    dgst,
+			Size:      int64(buf.Len()),
+		})
+	}
+	return fetcher, manifest
+}
+
+func TestGeneratePriorityList(t *testing.T) {
+	tests := []struct {
+		name    string
+		layers  [][]entry
+		config  specs.ImageConfig
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "no entrypoint",
+			layers:  [][]entry{{reg("bin/app", "")}},
+			wantErr: true,
+		},
+		{
+			name: "lookup in PATH with symlinks",
+			layers: [][]entry{{
+				dir("usr/"),
+				reg("usr/bin/app", "data"),
+				sym("bin", "usr/bin"),
+				sym("opt/app/bin/run", "../../../bin/app"),
+			}},
+			config: specs.ImageConfig{
+				Env: []string{"PATH=/opt/app/bin:/bin"},
+				Cmd: []string{"run"},
+			},
+			want: []string{"/usr/bin/app"},
+		},
+		{
+			name: "relative command uses working dir",
+			layers: [][]entry{{
+				reg("srv/start", "data"),
+			}},
+			config: specs.ImageConfig{
+				WorkingDir: "/srv",
+				Entrypoint: []string{"./start"},
+			},
+			want: []string{"/srv/start"},
+		},
+		{
+			name: "whiteout and opaque dir",
+			layers: [][]entry{
+				{reg("bin/app", "data"), reg("opt/old/app", "data")},
+				{reg("bin/.wh.app", ""), reg("opt/old/.wh..wh..opq", ""), reg("usr/bin/app", "data")},
+			},
+			config: specs.ImageConfig{
+				Env:        []string{"PATH=/opt/old:/bin:/usr/bin"},
+				Entrypoint: []string{"app"},
+			},
+			want: []string{"/usr/bin/app"},
+		},
+		{
+			name: "shebang with env and shell -c",
+			layers: [][]entry{{
+				reg("usr/bin/env", "data"),
+				reg("bin/sh", "data"),
+				reg("usr/bin/server", "data"),
+				reg("entry.sh", "#!/usr/bin/env -S sh -e\nexec server\n"),
+			}},
+			config: specs.ImageConfig{
+				Entrypoint: []string{"/entry.sh"},
+				Cmd:        []string{"sh", "-c", "FOO=bar exec server --port 80"},
+			},
+			want: []string{"/entry.sh", "/usr/bin/env", "/bin/sh", "/usr/bin/server"},
+		},
+		{
+			name: "python startup files and script",
+			layers: [][]entry{{
+				reg("usr/bin/python3.11", "data"),
+				sym("usr/bin/python3", "python3.11"),
+				reg("usr/lib/python3.11/os.py", ""),
+				reg("usr/lib/python3.11/site.py", ""),
+				reg("usr/lib/python3.11/__pycache__/os.cpython-311.pyc", ""),
+				reg("usr/lib/python3.11/encodings/__init__.py", ""),
+				reg("usr/lib/python3.11/site-packages/distutils-precedence.pth", ""),
+				reg("usr/lib/python3.11/json/__init__.py", ""),
+				reg("app/main.py", ""),
+			}},
+			config: specs.ImageConfig{
+				WorkingDir: "/app",
+				Cmd:        []string{"python3", "-u", "main.py"},
+			},
+			want: []string{
+				"/usr/bin/python3.11",
+				"/usr/lib/python3.11/site.py",
+				"/usr/lib/python3.11/os.py",
+				"/usr/lib/python3.11/__pycache__/os.cpython-311.pyc",
+				"/usr/lib/python3.11/encodings/__init__.py",
+				"/usr/lib/python3.11/site-packages/distutils-precedence.pth",
+				"/app/main.py",
+			},
+		},
+		{
+			name: "java runtime and classpath",
+			layers: [][]entry{{
+				reg("opt/jdk/bin/java", "data"),
+				reg("opt/jdk/lib/modules", ""),
+				reg("opt/jdk/lib/server/libjvm.so", "data"),
+				reg("app/libs/a.jar", ""),
+				reg("app/libs/b.jar", ""),
+				reg("app/app.jar", ""),
+			}},
+			config: specs.ImageConfig{
+				Env:        []string{"PATH=/opt/jdk/bin"},
+				Entrypoint: []string{"java", "-cp", "/app/app.jar:/app/libs/*", "Main"},
+			},
+			want: []string{
+				"/opt/jdk/bin/java",
+				"/opt/jdk/lib/server/libjvm.so",
+				"/opt/jdk/lib/modules",
+				"/app/app.jar",
+				"/app/libs/a.jar",
+				"/app/libs/b.jar",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			fetcher, manifest := buildImage(t, tt.layers...)
+			got, err := GeneratePriorityList(ctx, fetcher, manifest, specs.Image{Config: tt.config}, t.TempDir())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GeneratePriorityList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GeneratePriorityList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeneratePriorityList_elf(t *testing.T) {
+	bin, err := filepath.EvalSymlinks("/bin/sh")
+	if err != nil {
+		t.Skip("no /bin/sh on host")
+	}
+	ef, err := elf.Open(bin)
+	if err != nil {
+		t.Skip("/bin/sh is not an elf file")
+	}
+	var interp string
+	for _, prog := range ef.Progs {
+		if prog.Type == elf.PT_INTERP {
+			data, _ := io.ReadAll(prog.Open())
+			interp = strings.TrimRight(string(data), "\x00")
+		}
+	}
+	libs, _ := ef.ImportedLibraries()
+	ef.Close()
+	if interp == "" || len(libs) == 0 {
+		t.Skip("/bin/sh is statically linked")
+	}
+	content, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// put the libraries in a dir only known by ld.so.conf
+	layer := []entry{
+		reg("bin/sh", string(content)),
+		reg(strings.TrimPrefix(interp, "/"), "data"),
+		reg("etc/ld.so.conf", "include /etc/ld.so.conf.d/*.conf\n"),
+		reg("etc/ld.so.conf.d/custom.conf", "# custom libs\n/custom/lib\n"),
+	}
+	want := []string{"/bin/sh", interp}
+	for _, lib := range libs {
+		if lib == filepath.Base(interp) {
+			continue
+		}
+		layer = append(layer, reg("custom/lib/"+lib, "data"))
+		want = append(want, "/custom/lib/"+lib)
+	}
+
+	fetcher, manifest := buildImage(t, layer)
+	config := specs.Image{Config: specs.ImageConfig{Entrypoint: []string{"/bin/sh"}}}
+	got, err := GeneratePriorityList(context.Background(), fetcher, manifest, config, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GeneratePriorityList() = %v, want %v", got, want)
+	}
+}
+
+func TestWritePriorityList(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sub", "priority_list")
+	if err := WritePriorityList(file, []string{"/a", "/b"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "/a\n/b\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package prefetch
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	shells       = map[string]bool{"sh": true, "bash": true, "dash": true, "ash": true, "zsh": true}
+	pythonRegexp = regexp.MustCompile(`^python[0-9.]*$`)
+	envRegexp    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+)
+
+// modules imported by the python interpreter before running the main script
+var pythonStartupModules = []string{
+	"site", "os", "stat", "posixpath", "genericpath", "_collections_abc",
+	"_sitebuiltins", "abc", "codecs", "io", "encodings/__init__",
+	"encodings/aliases", "encodings/utf_8", "encodings/latin_1",
+}
+
+// runtimeFiles returns the files a well-known runtime loads before running
+// user code. p is the resolved command and args its arguments.
+func (a *Analyzer) runtimeFiles(p string, args []string) []task {
+	name := path.Base(p)
+	switch {
+	case shells[name]:
+		return a.shellFiles(args)
+	case pythonRegexp.MatchString(name):
+		return a.pythonFiles(name, args)
+	case name == "java":
+		return a.javaFiles(p, args)
+	}
+	return nil
+}
+
+// shellFiles follows the first command of `sh -c "cmd ..."`
+func (a *Analyzer) shellFiles(args []string) []task {
+	for i, arg := range args {
+		if arg != "-c" {
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil
+		}
+		fields := strings.Fields(args[i+1])
+		for j, f := range fields {
+			if envRegexp.MatchString(f) || f == "exec" {
+				continue
+			}
+			return []task{{kind: taskExec, path: f, args: fields[j+1:]}}
+		}
+		return nil
+	}
+	return nil
+}
+
+// pythonFiles adds the startup modules of the interpreter, the *.pth files of
+// site-packages and the main script.
+func (a *Analyzer) pythonFiles(name string, args []string) []task {
+	var deps []task
+	version := strings.TrimPrefix(name, "python")
+	libDirs := a.pythonLibDirs("/usr/lib/python"+version+"*", "/usr/local/lib/python"+version+"*")
+	for _, dir := range libDirs {
+		for _, m := range pythonStartupModules {
+			deps = append(deps, a.include(path.Join(dir, m+".py"))...)
+			moduleDir, module := path.Split(m)
+			for _, pyc := range a.glob(path.Join(dir, moduleDir, "__pycache__", module+".*.pyc")) {
+				deps = append(deps, a.include(pyc)...)
+			}
+		}
+		for _, pth := range a.glob(path.Join(dir, "*-packages", "*.pth")) {
+			deps = append(deps, a.include(pth)...)
+		}
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-m" || arg == "-c" || arg == "-" {
+			break
+		}
+		if strings.HasPrefix(arg, "-") {
+			// options taking a value
+			if arg == "-W" || arg == "-X" || arg == "--check-hash-based-pycs" {
+				i++
+			}
+			continue
+		}
+		script := arg
+		if !path.IsAbs(script) {
+			script = path.Join(a.workingDir(), script)
+		}
+		deps = append(deps, a.include(script)...)
+		break
+	}
+	return deps
+}
+
+// javaFiles adds the runtime image, the jvm library and the classpath of a java
+// command. JAVA_HOME is derived from the resolved binary, i.e. $JAVA_HOME/bin/java.
+func (a *Analyzer) javaFiles(p string, args []string) []task {
+	var deps []task
+	home := path.Dir(path.Dir(p))
+	for _, f := range []string{"lib/modules", "lib/jvm.cfg", "lib/rt.jar", "jre/lib/rt.jar"} {
+		deps = append(deps, a.include(path.Join(home, f))...)
+	}
+	for _, pattern := range []string{"lib/*/server/libjvm.so", "lib/server/libjvm.so", "jre/lib/*/server/libjvm.so"} {
+		for _, lib := range a.glob(path.Join(home, pattern)) {
+			deps = append(deps, a.file(lib)...)
+		}
+	}
+
+	classpath := a.getEnv("CLASSPATH", "")
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-jar":
+			if i+1 < len(args) {
+				deps = append(deps, a.classpathFiles(args[i+1])...)
+			}
+			return deps
+		case "-cp", "-classpath", "--class-path":
+			if i+1 < len(args) {
+				classpath = args[i+1]
+				i++
+			}
+		}
+	}
+	for _, entry := range strings.Split(classpath, ":") {
+		deps = append(deps, a.classpathFiles(entry)...)
+	}
+	return deps
+}
+
+// classpathFiles handles a single classpath entry, `dir/*` means all jars in dir
+func (a *Analyzer) classpathFiles(entry string) []task {
+	if entry == "" {
+		return nil
+	}
+	if !path.IsAbs(entry) {
+		entry = path.Join(a.workingDir(), entry)
+	}
+	if path.Base(entry) != "*" {
+		return a.include(entry)
+	}
+	// the dir itself may be missing from the layer tars
+	dir := path.Dir(entry)
+	if r, _, ok := a.resolve(dir, 0); ok {
+		dir = r
+	}
+	var deps []task
+	for _, jar := range a.glob(path.Join(dir, "*.jar")) {
+		deps = append(deps, a.include(jar)...)
+	}
+	return deps
+}
+
+// pythonLibDirs returns the stdlib dirs of the python interpreter, i.e. the
+// dirs matching patterns which contain os.py
+func (a *Analyzer) pythonLibDirs(patterns ...string) []string {
+	var dirs []string
+	for _, pattern := range patterns {
+		for _, p := range a.glob(path.Join(pattern, "os.py")) {
+			dirs = append(dirs, path.Dir(p))
+		}
+	}
+	return dirs
+}
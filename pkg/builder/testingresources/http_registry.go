@@ -0,0 +1,639 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testingresources
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// HTTPRegistry serves a TestRegistry over the OCI distribution API, so that the
+// docker resolver used by the builder can be tested end-to-end.
+// Features: Pull, Push (monolithic and chunked uploads), cross repository
+// mounts, the referrers API, bearer token auth and fault injection.
+// Limitations: Delete, catalog and tag listing are not supported.
+type HTTPRegistry struct {
+	reg    *TestRegistry
+	server *httptest.Server
+	opts   HTTPRegistryOptions
+	token  string
+
+	// mu guards the registry, which is not safe for concurrent use
+	mu        sync.Mutex
+	uploads   map[string]*upload
+	referrers map[string]map[digest.Digest][]v1.Descriptor // repository -> subject -> referrers
+	faults    []*faultState
+	requests  []string
+}
+
+type HTTPRegistryOptions struct {
+	RegistryOptions
+
+	// Username and Password enable bearer token auth, tokens are issued by
+	// the /token endpoint to clients presenting these credentials
+	Username string
+	Password string
+
+	// TLS serves https instead of plain HTTP, Client trusts its certificate
+	TLS bool
+}
+
+// Fault changes the responses to the matching requests
+type Fault struct {
+	// Method and Path select the requests, Path matches a substring of the
+	// request path. Empty matches all requests.
+	Method string
+	Path   string
+	// Times is the number of requests the fault applies to, 0 means all
+	Times int
+
+	// Latency delays the response
+	Latency time.Duration
+	// Status is returned instead of serving the request, if set
+	Status int
+	// Truncate closes the connection after half of the response body
+	Truncate bool
+}
+
+type faultState struct {
+	Fault
+	hits int
+}
+
+type upload struct {
+	repository string
+	data       []byte
+}
+
+const registryService = "testregistry"
+
+// NewHTTPRegistry starts a registry serving the repositories of
+// opts.LocalRegistryPath, the default local registry if empty. It is closed
+// when the test finishes.
+func NewHTTPRegistry(t *testing.T, ctx context.Context, opts HTTPRegistryOptions) *HTTPRegistry {
+	if opts.LocalRegistryPath == "" && !opts.InmemoryRegistryOnly {
+		opts.LocalRegistryPath = GetLocalRegistryPath()
+	}
+	reg, err := NewTestRegistry(ctx, opts.RegistryOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	r := &HTTPRegistry{
+		reg:       reg,
+		opts:      opts,
+		token:     hex.EncodeToString(b),
+		uploads:   make(map[string]*upload),
+		referrers: make(map[string]map[digest.Digest][]v1.Descriptor),
+	}
+	if opts.TLS {
+		r.server = httptest.NewTLSServer(r)
+	} else {
+		r.server = httptest.NewServer(r)
+	}
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// Host returns the host:port of the registry
+func (r *HTTPRegistry) Host() string {
+	return r.server.Listener.Addr().String()
+}
+
+// Ref returns the reference of an image in the registry, e.g. Ref("hello-world:amd64")
+func (r *HTTPRegistry) Ref(image string) string {
+	return r.Host() + "/" + image
+}
+
+// Client returns a client trusting the certificate of the registry
+func (r *HTTPRegistry) Client() *http.Client {
+	return r.server.Client()
+}
+
+// Registry returns the underlying TestRegistry
+func (r *HTTPRegistry) Registry() *TestRegistry {
+	return r.reg
+}
+
+// InjectFault applies f to the matching requests from now on
+func (r *HTTPRegistry) InjectFault(f Fault) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.faults = append(r.faults, &faultState{Fault: f})
+}
+
+// ClearFaults removes all injected faults
+func (r *HTTPRegistry) ClearFaults() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.faults = nil
+}
+
+// Requests returns the requests served so far, as "METHOD /path?query"
+func (r *HTTPRegistry) Requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.requests...)
+}
+
+func (r *HTTPRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.RequestURI())
+	var fault *Fault
+	for _, f := range r.faults {
+		if (f.Method == "" || f.Method == req.Method) && strings.Contains(req.URL.Path, f.Path) &&
+			(f.Times == 0 || f.hits < f.Times) {
+			f.hits++
+			fault = &f.Fault
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if fault != nil {
+		if fault.Latency > 0 {
+			select {
+			case <-time.After(fault.Latency):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		if fault.Status != 0 {
+			writeError(w, fault.Status, "UNAVAILABLE", "injected fault")
+			return
+		}
+		if fault.Truncate {
+			w = &truncateWriter{ResponseWriter: w}
+		}
+	}
+
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, "/v2/") {
+		http.NotFound(w, req)
+		return
+	}
+	rest := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if !r.authorized(w, req, rest) {
+		return
+	}
+
+	switch {
+	case rest == "":
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(rest, "/blobs/uploads/"):
+		i := strings.LastIndex(rest, "/blobs/uploads/")
+		r.serveUpload(w, req, rest[:i], rest[i+len("/blobs/uploads/"):])
+	case strings.Contains(rest, "/manifests/"):
+		i := strings.LastIndex(rest, "/manifests/")
+		r.serveManifest(w, req, rest[:i], rest[i+len("/manifests/"):])
+	case strings.Contains(rest, "/blobs/"):
+		i := strings.LastIndex(rest, "/blobs/")
+		r.serveBlob(w, req, rest[:i], rest[i+len("/blobs/"):])
+	case strings.Contains(rest, "/referrers/"):
+		i := strings.LastIndex(rest, "/referrers/")
+		r.serveReferrers(w, req, rest[:i], rest[i+len("/referrers/"):])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// authorized checks the bearer token, challenging the client if missing
+func (r *HTTPRegistry) authorized(w http.ResponseWriter, req *http.Request, rest string) bool {
+	if r.opts.Username == "" {
+		return true
+	}
+	if req.Header.Get("Authorization") == "Bearer "+r.token {
+		return true
+	}
+	scheme := "http"
+	if r.opts.TLS {
+		scheme = "https"
+	}
+	challenge := fmt.Sprintf(`Bearer realm="%s://%s/token",service="%s"`, scheme, req.Host, registryService)
+	for _, marker := range []string{"/manifests/", "/blobs/", "/referrers/"} {
+		if i := strings.LastIndex(rest, marker); i > 0 {
+			challenge += fmt.Sprintf(`,scope="repository:%s:pull,push"`, rest[:i])
+			break
+		}
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+	return false
+}
+
+// serveToken issues tokens by basic auth (GET) or the oauth password grant (POST)
+func (r *HTTPRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	var username, password string
+	key := "token"
+	switch req.Method {
+	case http.MethodGet:
+		username, password, _ = req.BasicAuth()
+	case http.MethodPost:
+		if err := req.ParseForm(); err != nil {
+			writeError(w, http.StatusBadRequest, "UNSUPPORTED", err.Error())
+			return
+		}
+		username, password = req.PostForm.Get("username"), req.PostForm.Get("password")
+		key = "access_token"
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if username != r.opts.Username || password != r.opts.Password {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credentials")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{key: r.token, "expires_in": 300})
+}
+
+func (r *HTTPRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repository, ref string) {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		r.mu.Lock()
+		desc, data, err := r.getManifest(ctx, repository, ref)
+		r.mu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", desc.MediaType)
+		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodPut:
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		desc := v1.Descriptor{
+			MediaType: req.Header.Get("Content-Type"),
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+		}
+		tag := ref
+		if dgst, err := digest.Parse(ref); err == nil {
+			if dgst != desc.Digest {
+				writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest mismatch")
+				return
+			}
+			tag = ""
+		}
+		var manifest struct {
+			ArtifactType string            `json:"artifactType"`
+			Config       v1.Descriptor     `json:"config"`
+			Subject      *v1.Descriptor    `json:"subject"`
+			Annotations  map[string]string `json:"annotations"`
+		}
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+
+		r.mu.Lock()
+		err = r.reg.Push(ctx, repository, tag, desc, data)
+		if err == nil && manifest.Subject != nil {
+			referrer := desc
+			referrer.ArtifactType = manifest.ArtifactType
+			if referrer.ArtifactType == "" {
+				referrer.ArtifactType = manifest.Config.MediaType
+			}
+			referrer.Annotations = manifest.Annotations
+			if r.referrers[repository] == nil {
+				r.referrers[repository] = make(map[digest.Digest][]v1.Descriptor)
+			}
+			r.referrers[repository][manifest.Subject.Digest] = append(r.referrers[repository][manifest.Subject.Digest], referrer)
+		}
+		r.mu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", err.Error())
+			return
+		}
+		if manifest.Subject != nil {
+			w.Header().Set("OCI-Subject", manifest.Subject.Digest.String())
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", repository, desc.Digest))
+		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getManifest returns the manifest of a tag or digest
+func (r *HTTPRegistry) getManifest(ctx context.Context, repository, ref string) (v1.Descriptor, []byte, error) {
+	desc := v1.Descriptor{}
+	if dgst, err := digest.Parse(ref); err == nil {
+		desc.Digest = dgst
+	} else {
+		repo, ok := r.reg.internalRegistry[repository]
+		if !ok {
+			return v1.Descriptor{}, nil, errdefs.ErrNotFound
+		}
+		if desc, err = repo.Resolve(ctx, ref); err != nil {
+			return v1.Descriptor{}, nil, err
+		}
+	}
+	data, err := r.fetch(ctx, repository, desc)
+	if err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+	desc.Size = int64(len(data))
+	var manifest struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return v1.Descriptor{}, nil, fmt.Errorf("%s is not a manifest: %w", ref, err)
+	}
+	desc.MediaType = manifest.MediaType
+	if desc.MediaType == "" {
+		desc.MediaType = v1.MediaTypeImageManifest
+		if manifest.Manifests != nil {
+			desc.MediaType = v1.MediaTypeImageIndex
+		}
+	}
+	return desc, data, nil
+}
+
+func (r *HTTPRegistry) fetch(ctx context.Context, repository string, desc v1.Descriptor) ([]byte, error) {
+	rc, err := r.reg.Fetch(ctx, repository, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (r *HTTPRegistry) serveBlob(w http.ResponseWriter, req *http.Request, repository, ref string) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	r.mu.Lock()
+	data, err := r.fetch(req.Context(), repository, v1.Descriptor{Digest: dgst})
+	r.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (r *HTTPRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repository, id string) {
+	ctx := req.Context()
+	query := req.URL.Query()
+
+	if id == "" {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// cross repository mount, falls back to an upload session if the blob is missing
+		if mount, from := query.Get("mount"), query.Get("from"); mount != "" && from != "" {
+			if dgst, err := digest.Parse(mount); err == nil {
+				r.mu.Lock()
+				err = r.reg.Mount(ctx, from, repository, v1.Descriptor{Digest: dgst})
+				r.mu.Unlock()
+				if err == nil {
+					blobCreated(w, repository, dgst)
+					return
+				}
+			}
+		}
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+			return
+		}
+		// monolithic upload
+		if query.Get("digest") != "" {
+			r.commitUpload(w, req, repository, data)
+			return
+		}
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+		r.mu.Lock()
+		r.uploads[id] = &upload{repository: repository, data: data}
+		r.mu.Unlock()
+		uploadAccepted(w, repository, id, int64(len(data)), http.StatusAccepted)
+		return
+	}
+
+	r.mu.Lock()
+	u, ok := r.uploads[id]
+	r.mu.Unlock()
+	if !ok || u.repository != repository {
+		writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload not found")
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		r.mu.Lock()
+		size := int64(len(u.data))
+		r.mu.Unlock()
+		uploadAccepted(w, repository, id, size, http.StatusNoContent)
+	case http.MethodDelete:
+		r.mu.Lock()
+		delete(r.uploads, id)
+		r.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch, http.MethodPut:
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+			return
+		}
+		r.mu.Lock()
+		if cr := req.Header.Get("Content-Range"); cr != "" {
+			var start, end int64
+			if _, err := fmt.Sscanf(cr, "%d-%d", &start, &end); err != nil || start != int64(len(u.data)) {
+				size := int64(len(u.data))
+				r.mu.Unlock()
+				w.Header().Set("Range", rangeHeader(size))
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "invalid content range "+cr)
+				return
+			}
+		}
+		u.data = append(u.data, data...)
+		size := int64(len(u.data))
+		if req.Method == http.MethodPut {
+			delete(r.uploads, id)
+		}
+		r.mu.Unlock()
+		if req.Method == http.MethodPut {
+			r.commitUpload(w, req, repository, u.data)
+			return
+		}
+		uploadAccepted(w, repository, id, size, http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// commitUpload verifies the uploaded data against the digest parameter and stores it
+func (r *HTTPRegistry) commitUpload(w http.ResponseWriter, req *http.Request, repository string, data []byte) {
+	dgst, err := digest.Parse(req.URL.Query().Get("digest"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	if digest.FromBytes(data) != dgst {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest mismatch")
+		return
+	}
+	desc := v1.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    dgst,
+		Size:      int64(len(data)),
+	}
+	r.mu.Lock()
+	err = r.reg.Push(req.Context(), repository, "", desc, data)
+	r.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	blobCreated(w, repository, dgst)
+}
+
+func (r *HTTPRegistry) serveReferrers(w http.ResponseWriter, req *http.Request, repository, ref string) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	artifactType := req.URL.Query().Get("artifactType")
+	index := v1.Index{
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}
+	index.SchemaVersion = 2
+	r.mu.Lock()
+	for _, desc := range r.referrers[repository][dgst] {
+		if artifactType == "" || desc.ArtifactType == artifactType {
+			index.Manifests = append(index.Manifests, desc)
+		}
+	}
+	r.mu.Unlock()
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+	writeJSON(w, http.StatusOK, index)
+}
+
+func blobCreated(w http.ResponseWriter, repository string, dgst digest.Digest) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repository, dgst))
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func uploadAccepted(w http.ResponseWriter, repository, id string, size int64, status int) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repository, id))
+	w.Header().Set("Range", rangeHeader(size))
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+}
+
+func rangeHeader(size int64) string {
+	if size == 0 {
+		return "0-0"
+	}
+	return fmt.Sprintf("0-%d", size-1)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, _ := json.Marshal(v)
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+var errTruncated = errors.New("response truncated by injected fault")
+
+// truncateWriter writes half of the announced body, the connection is closed
+// by net/http as the body is shorter than its Content-Length
+type truncateWriter struct {
+	http.ResponseWriter
+	limit int64
+}
+
+func (w *truncateWriter) WriteHeader(status int) {
+	if cl, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+		w.limit = cl / 2
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *truncateWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.limit {
+		n, _ := w.ResponseWriter.Write(p[:w.limit])
+		w.limit = 0
+		return n, errTruncated
+	}
+	w.limit -= int64(len(p))
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,200 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testingresources
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestHTTPRegistry_Auth(t *testing.T) {
+	reg := NewHTTPRegistry(t, context.Background(), HTTPRegistryOptions{Username: "user", Password: "pass"})
+	url := "http://" + reg.Host() + "/v2/hello-world/manifests/amd64"
+
+	resp, err := http.Head(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	Assert(t, resp.StatusCode == http.StatusUnauthorized, fmt.Sprintf("got status %d without token, expected 401", resp.StatusCode))
+	challenge := resp.Header.Get("WWW-Authenticate")
+	Assert(t, strings.Contains(challenge, `scope="repository:hello-world:pull,push"`), "unexpected challenge "+challenge)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+reg.Host()+"/token", nil)
+	req.SetBasicAuth("user", "wrong")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	Assert(t, resp.StatusCode == http.StatusUnauthorized, "token issued for invalid credentials")
+
+	req.SetBasicAuth("user", "pass")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(resp.Body).Decode(&token)
+	resp.Body.Close()
+
+	req, _ = http.NewRequest(http.MethodHead, url, nil)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	Assert(t, resp.StatusCode == http.StatusOK, fmt.Sprintf("got status %d with token, expected 200", resp.StatusCode))
+	Assert(t, resp.Header.Get("Docker-Content-Digest") == DockerV2_Manifest_Simple_Digest, "unexpected manifest digest")
+}
+
+func TestHTTPRegistry_ChunkedUpload(t *testing.T) {
+	reg := NewHTTPRegistry(t, context.Background(), HTTPRegistryOptions{})
+	base := "http://" + reg.Host()
+	do := func(method, url, contentRange string, body []byte) *http.Response {
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		if contentRange != "" {
+			req.Header.Set("Content-Range", contentRange)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	blob := []byte("hello chunked upload")
+	dgst := digest.FromBytes(blob)
+	resp := do(http.MethodPost, base+"/v2/upload/blobs/uploads/", "", nil)
+	Assert(t, resp.StatusCode == http.StatusAccepted, fmt.Sprintf("got status %d on POST, expected 202", resp.StatusCode))
+	location := base + resp.Header.Get("Location")
+
+	resp = do(http.MethodPatch, location, "0-4", blob[:5])
+	Assert(t, resp.StatusCode == http.StatusAccepted, fmt.Sprintf("got status %d on PATCH, expected 202", resp.StatusCode))
+	Assert(t, resp.Header.Get("Range") == "0-4", "unexpected range "+resp.Header.Get("Range"))
+
+	resp = do(http.MethodPatch, location, "10-14", blob[10:15])
+	Assert(t, resp.StatusCode == http.StatusRequestedRangeNotSatisfiable, fmt.Sprintf("got status %d on out of order PATCH, expected 416", resp.StatusCode))
+
+	resp = do(http.MethodGet, location, "", nil)
+	Assert(t, resp.StatusCode == http.StatusNoContent && resp.Header.Get("Range") == "0-4", "unexpected upload status")
+
+	resp = do(http.MethodPatch, location, "5-14", blob[5:15])
+	Assert(t, resp.StatusCode == http.StatusAccepted, fmt.Sprintf("got status %d on PATCH, expected 202", resp.StatusCode))
+
+	resp = do(http.MethodPut, location+"?digest="+dgst.String(), "", blob[15:])
+	Assert(t, resp.StatusCode == http.StatusCreated, fmt.Sprintf("got status %d on PUT, expected 201", resp.StatusCode))
+
+	rc, err := reg.Registry().Fetch(context.Background(), "upload", v1.Descriptor{Digest: dgst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	Assert(t, bytes.Equal(data, blob), "uploaded blob mismatch")
+}
+
+func TestHTTPRegistry_Referrers(t *testing.T) {
+	ctx := context.Background()
+	reg := NewHTTPRegistry(t, ctx, HTTPRegistryOptions{RegistryOptions: RegistryOptions{ManifestPushIgnoresLayers: true}})
+	subject := v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: DockerV2_Manifest_Simple_Digest, Size: DockerV2_Manifest_Simple_Size}
+
+	push := func(artifactType string) digest.Digest {
+		manifest := v1.Manifest{
+			MediaType:    v1.MediaTypeImageManifest,
+			ArtifactType: artifactType,
+			Config:       v1.DescriptorEmptyJSON,
+			Subject:      &subject,
+		}
+		manifest.SchemaVersion = 2
+		data, _ := json.Marshal(manifest)
+		dgst := digest.FromBytes(data)
+		req, _ := http.NewRequest(http.MethodPut, "http://"+reg.Host()+"/v2/hello-world/manifests/"+dgst.String(), bytes.NewReader(data))
+		req.Header.Set("Content-Type", v1.MediaTypeImageManifest)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		Assert(t, resp.StatusCode == http.StatusCreated, fmt.Sprintf("got status %d on PUT, expected 201", resp.StatusCode))
+		Assert(t, resp.Header.Get("OCI-Subject") == subject.Digest.String(), "OCI-Subject isn't returned")
+		return dgst
+	}
+	referrers := func(query string) []v1.Descriptor {
+		resp, err := http.Get("http://" + reg.Host() + "/v2/hello-world/referrers/" + subject.Digest.String() + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var index v1.Index
+		if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+			t.Fatal(err)
+		}
+		return index.Manifests
+	}
+
+	obd := push("application/vnd.containerd.overlaybd.native.v1+json")
+	push("application/vnd.example.signature")
+
+	Assert(t, len(referrers("")) == 2, "expected 2 referrers")
+	filtered := referrers("?artifactType=application/vnd.containerd.overlaybd.native.v1%2Bjson")
+	Assert(t, len(filtered) == 1 && filtered[0].Digest == obd, "referrers aren't filtered by artifactType")
+}
+
+func TestHTTPRegistry_Faults(t *testing.T) {
+	reg := NewHTTPRegistry(t, context.Background(), HTTPRegistryOptions{})
+	url := "http://" + reg.Host() + "/v2/hello-world/blobs/" + DockerV2_Manifest_Simple_Layer_0_Digest
+
+	reg.InjectFault(Fault{Path: "/blobs/", Times: 1, Status: http.StatusInternalServerError})
+	reg.InjectFault(Fault{Path: "/blobs/", Times: 1, Truncate: true})
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	Assert(t, resp.StatusCode == http.StatusInternalServerError, fmt.Sprintf("got status %d, expected 500", resp.StatusCode))
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	Assert(t, err != nil, "truncated body is read without error")
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	Assert(t, err == nil && digest.FromBytes(data).String() == DockerV2_Manifest_Simple_Layer_0_Digest, "blob isn't served after the faults")
+}
@@ -19,21 +19,31 @@ package testingresources
 import (
 	"context"
 	"sync"
+	"time"
 
-	"github.com/containerd/accelerated-container-image/cmd/convertor/database"
+	"github.com/containerd/accelerated-container-image/pkg/database"
 	"github.com/opencontainers/go-digest"
 )
 
 type localdb struct {
 	layerRecords    []*database.LayerEntry
 	manifestRecords []*database.ManifestEntry
+	leases          map[string]*lease
 	layerLock       sync.Mutex // Protects layerRecords
 	manifestLock    sync.Mutex // Protects manifestRecords
+	leaseLock       sync.Mutex // Protects leases
+}
+
+type lease struct {
+	owner    string
+	expireAt time.Time
 }
 
 // NewLocalDB returns a new local database for testing. This is a simple unoptimized in-memory database.
 func NewLocalDB() database.ConversionDatabase {
-	return &localdb{}
+	return &localdb{
+		leases: make(map[string]*lease),
+	}
 }
 
 func (l *localdb) CreateLayerEntry(ctx context.Context, host string, repository string, convertedDigest digest.Digest, chainID string, size int64) error {
@@ -133,3 +143,28 @@ func (l *localdb) DeleteManifestEntry(ctx context.Context, host, repository, med
 	}
 	return nil // No error if entry not found
 }
+
+func (l *localdb) AcquireLayerLease(ctx context.Context, host, chainID, profile, owner string, ttl time.Duration) (bool, error) {
+	l.leaseLock.Lock()
+	defer l.leaseLock.Unlock()
+	key := host + "/" + chainID + "/" + profile
+	now := time.Now()
+	if cur, ok := l.leases[key]; ok && cur.owner != owner && cur.expireAt.After(now) {
+		return false, nil
+	}
+	l.leases[key] = &lease{
+		owner:    owner,
+		expireAt: now.Add(ttl),
+	}
+	return true, nil
+}
+
+func (l *localdb) ReleaseLayerLease(ctx context.Context, host, chainID, profile, owner string) error {
+	l.leaseLock.Lock()
+	defer l.leaseLock.Unlock()
+	key := host + "/" + chainID + "/" + profile
+	if cur, ok := l.leases[key]; ok && cur.owner == owner {
+		delete(l.leases, key)
+	}
+	return nil
+}
@@ -17,14 +17,18 @@
 package testingresources
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"os"
 	"path/filepath"
 
 	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
 	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -155,3 +159,129 @@ func (r *TestRegistry) Mount(ctx context.Context, srcRepository string, targetRe
 	}
 	return r.Push(ctx, targetRepository, "", desc, body)
 }
+
+// Copy copies the image manifest tagged tag from srcRepository to targetRepository,
+// mounting its config and layers
+func (r *TestRegistry) Copy(ctx context.Context, srcRepository string, targetRepository string, tag string) error {
+	repo, ok := r.internalRegistry[srcRepository]
+	if !ok {
+		return errdefs.ErrNotFound
+	}
+	desc, err := repo.Resolve(ctx, tag)
+	if err != nil {
+		return err
+	}
+	rd, err := r.Fetch(ctx, srcRepository, desc)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	body, err := io.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	manifest := v1.Manifest{}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return err
+	}
+	for _, blob := range append([]v1.Descriptor{manifest.Config}, manifest.Layers...) {
+		if err := r.Mount(ctx, srcRepository, targetRepository, blob); err != nil {
+			return err
+		}
+	}
+	return r.Push(ctx, targetRepository, tag, desc, body)
+}
+
+// Recompress copies the image manifest tagged tag from srcRepository to
+// targetRepository, with its layers recompressed to compress. The config is
+// mounted since the diffIDs don't change.
+func (r *TestRegistry) Recompress(ctx context.Context, srcRepository string, targetRepository string, tag string, compress compression.Compression) error {
+	repo, ok := r.internalRegistry[srcRepository]
+	if !ok {
+		return errdefs.ErrNotFound
+	}
+	desc, err := repo.Resolve(ctx, tag)
+	if err != nil {
+		return err
+	}
+	body, err := r.readBlob(ctx, srcRepository, desc)
+	if err != nil {
+		return err
+	}
+	manifest := v1.Manifest{}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return err
+	}
+	if err := r.Mount(ctx, srcRepository, targetRepository, manifest.Config); err != nil {
+		return err
+	}
+	docker := images.IsDockerType(manifest.MediaType)
+	for i, layer := range manifest.Layers {
+		data, err := r.readBlob(ctx, srcRepository, layer)
+		if err != nil {
+			return err
+		}
+		dr, err := compression.DecompressStream(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		cw, err := compression.CompressStream(&buf, compress)
+		if err != nil {
+			dr.Close()
+			return err
+		}
+		_, err = io.Copy(cw, dr)
+		dr.Close()
+		if err != nil {
+			return err
+		}
+		if err := cw.Close(); err != nil {
+			return err
+		}
+		layer = v1.Descriptor{
+			MediaType: layerMediaType(compress, docker),
+			Digest:    digest.FromBytes(buf.Bytes()),
+			Size:      int64(buf.Len()),
+		}
+		if err := r.Push(ctx, targetRepository, "", layer, buf.Bytes()); err != nil {
+			return err
+		}
+		manifest.Layers[i] = layer
+	}
+	if body, err = json.Marshal(manifest); err != nil {
+		return err
+	}
+	desc = v1.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    digest.FromBytes(body),
+		Size:      int64(len(body)),
+	}
+	return r.Push(ctx, targetRepository, tag, desc, body)
+}
+
+func (r *TestRegistry) readBlob(ctx context.Context, repository string, desc v1.Descriptor) ([]byte, error) {
+	rd, err := r.Fetch(ctx, repository, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return io.ReadAll(rd)
+}
+
+func layerMediaType(compress compression.Compression, docker bool) string {
+	switch {
+	case compress == compression.Gzip && docker:
+		return images.MediaTypeDockerSchema2LayerGzip
+	case compress == compression.Gzip:
+		return v1.MediaTypeImageLayerGzip
+	case compress == compression.Zstd && docker:
+		return images.MediaTypeDockerSchema2LayerZstd
+	case compress == compression.Zstd:
+		return v1.MediaTypeImageLayerZstd
+	case docker:
+		return images.MediaTypeDockerSchema2Layer
+	default:
+		return v1.MediaTypeImageLayer
+	}
+}
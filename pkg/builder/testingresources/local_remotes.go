@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"time"
 
 	"github.com/containerd/containerd/v2/core/content"
@@ -157,7 +158,11 @@ func (p MockLocalPusher) push(ctx context.Context, desc v1.Descriptor, ref strin
 	}
 
 	// Layer mounts
-	if mountRepo, ok := desc.Annotations[fmt.Sprintf("%s.%s", labelDistributionSource, p.host)]; ok {
+	host := p.host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if mountRepo, ok := desc.Annotations[fmt.Sprintf("%s.%s", labelDistributionSource, host)]; ok {
 		err = p.testReg.Mount(ctx, mountRepo, p.repository, desc)
 		if err != nil {
 			return nil, err
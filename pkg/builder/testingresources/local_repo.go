@@ -168,7 +168,15 @@ func (r *RepoStore) Push(ctx context.Context, desc v1.Descriptor, tag string, co
 		return err
 	}
 	if exists {
-		return nil // No error is returned on push if image is already present
+		// No error is returned on push if image is already present, only the tag is updated
+		switch desc.MediaType {
+		case v1.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest,
+			v1.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			if tag != "" {
+				r.inmemoryRepo.tags[tag] = desc.Digest
+			}
+		}
+		return nil
 	}
 	isManifest := false
 	switch desc.MediaType {
@@ -21,6 +21,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"testing"
 
 	"github.com/containerd/containerd/v2/core/remotes"
@@ -28,11 +29,12 @@ import (
 )
 
 func GetLocalRegistryPath() string {
-	cwd, err := os.Getwd()
-	if err != nil {
-		panic(err)
+	// relative to this file, so that it works for tests of any package
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		panic("failed to get the path of testingresources")
 	}
-	return path.Join(cwd, "..", "testingresources", "mocks", "registry")
+	return path.Join(path.Dir(file), "mocks", "registry")
 }
 
 // GetTestRegistry returns a TestRegistry with the specified options. If opts.LocalRegistryPath is not specified,
@@ -22,6 +22,7 @@ import (
 	"os"
 	"path"
 
+	"github.com/containerd/accelerated-container-image/pkg/builder/cache"
 	"github.com/containerd/accelerated-container-image/pkg/label"
 	sn "github.com/containerd/accelerated-container-image/pkg/types"
 	"github.com/containerd/accelerated-container-image/pkg/utils"
@@ -32,8 +33,8 @@ import (
 	"github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 
+	"github.com/containerd/log"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -54,10 +55,13 @@ type turboOCIBuilderEngine struct {
 	*builderEngineBase
 	overlaybdConfig *sn.OverlayBDBSConfig
 	tociLayers      []specs.Descriptor
-	isGzip          []bool
+	compress        []compression.Compression
+	targetLayers    []specs.Descriptor
+	chainIDs        []string
+	fromCache       []bool
 }
 
-func NewTurboOCIBuilderEngine(base *builderEngineBase) builderEngine {
+func NewTurboOCIBuilderEngine(base *builderEngineBase) Engine {
 	config := &sn.OverlayBDBSConfig{
 		Lowers:     []sn.OverlayBDBSConfigLower{},
 		ResultFile: "",
@@ -66,53 +70,64 @@ func NewTurboOCIBuilderEngine(base *builderEngineBase) builderEngine {
 		config.Lowers = append(config.Lowers, sn.OverlayBDBSConfigLower{
 			File: overlaybdBaseLayer,
 		})
-		logrus.Infof("using default baselayer")
+		log.L.Infof("using default baselayer")
 	}
 	return &turboOCIBuilderEngine{
 		builderEngineBase: base,
 		overlaybdConfig:   config,
 		tociLayers:        make([]specs.Descriptor, len(base.manifest.Layers)),
-		isGzip:            make([]bool, len(base.manifest.Layers)),
+		compress:          make([]compression.Compression, len(base.manifest.Layers)),
+		targetLayers:      make([]specs.Descriptor, len(base.manifest.Layers)),
+		chainIDs:          base.layerChainIDs(),
+		fromCache:         make([]bool, len(base.manifest.Layers)),
 	}
 }
 
 func (e *turboOCIBuilderEngine) DownloadLayer(ctx context.Context, idx int) error {
 	var err error
-	if e.isGzip[idx], err = e.isGzipLayer(ctx, idx); err != nil {
+	if e.compress[idx], err = e.layerCompression(ctx, idx); err != nil {
 		return err
 	}
 
 	desc := e.manifest.Layers[idx]
 	targetFile := path.Join(e.getLayerDir(idx), "layer.tar")
-	return downloadLayer(ctx, e.fetcher, targetFile, desc, false)
-}
-
-func (e *turboOCIBuilderEngine) BuildLayer(ctx context.Context, idx int) error {
-	layerDir := e.getLayerDir(idx)
-	if err := e.create(ctx, idx); err != nil {
-		return err
-	}
-	e.overlaybdConfig.Upper = sn.OverlayBDBSConfigUpper{
-		Data:   path.Join(layerDir, "writable_data"),
-		Index:  path.Join(layerDir, "writable_index"),
-		Target: path.Join(layerDir, "layer.tar"),
-	}
-	if err := writeConfig(layerDir, e.overlaybdConfig); err != nil {
+	// overlaybd can't seek in zstd streams, zstd layers are decompressed and
+	// the uncompressed tar is uploaded as the turboOCI data, see UploadLayer.
+	if err := downloadLayer(ctx, e.fetcher, targetFile, desc, e.isZstd(idx)); err != nil {
 		return err
 	}
-	if err := e.apply(ctx, layerDir); err != nil {
-		return err
+	e.targetLayers[idx] = e.manifest.Layers[idx]
+	if e.isZstd(idx) {
+		if e.targetLayers[idx], err = getFileDesc(targetFile, false); err != nil {
+			return errors.Wrapf(err, "failed to get descriptor of decompressed layer %d", idx)
+		}
 	}
+	return nil
+}
 
-	var fsMetaFile string
-	if e.fstype == "" {
-		fsMetaFile = "ext4" + fsMetaFileSuffix
+func (e *turboOCIBuilderEngine) BuildLayer(ctx context.Context, idx int) error {
+	layerDir := e.getLayerDir(idx)
+	fsMetaFile := e.fsMetaFile()
+	if e.fromCache[idx] {
+		log.G(ctx).Debugf("layer %d is from cache", idx)
 	} else {
-		fsMetaFile = e.fstype + fsMetaFileSuffix
-	}
-
-	if err := e.commit(ctx, layerDir, fsMetaFile); err != nil {
-		return err
+		if err := e.create(ctx, idx); err != nil {
+			return err
+		}
+		e.overlaybdConfig.Upper = sn.OverlayBDBSConfigUpper{
+			Data:   path.Join(layerDir, "writable_data"),
+			Index:  path.Join(layerDir, "writable_index"),
+			Target: path.Join(layerDir, "layer.tar"),
+		}
+		if err := writeConfig(layerDir, e.overlaybdConfig); err != nil {
+			return err
+		}
+		if err := e.apply(ctx, layerDir); err != nil {
+			return err
+		}
+		if err := e.commit(ctx, layerDir, fsMetaFile); err != nil {
+			return err
+		}
 	}
 	if err := e.createIdentifier(idx); err != nil {
 		return errors.Wrapf(err, "failed to create identifier %q", tociIdentifier)
@@ -122,7 +137,7 @@ func (e *turboOCIBuilderEngine) BuildLayer(ctx context.Context, idx int) error {
 		path.Join(layerDir, tociIdentifier),
 	}
 	gzipIndexPath := ""
-	if e.isGzip[idx] {
+	if e.isGzip(idx) {
 		gzipIndexPath = path.Join(layerDir, gzipMetaFile)
 		files = append(files, gzipIndexPath)
 	}
@@ -131,7 +146,7 @@ func (e *turboOCIBuilderEngine) BuildLayer(ctx context.Context, idx int) error {
 	}
 	e.overlaybdConfig.Lowers = append(e.overlaybdConfig.Lowers, sn.OverlayBDBSConfigLower{
 		TargetFile:   path.Join(layerDir, "layer.tar"),
-		TargetDigest: string(e.manifest.Layers[idx].Digest), // TargetDigest should be set to work with gzip cache
+		TargetDigest: string(e.targetLayers[idx].Digest), // TargetDigest should be set to work with gzip cache
 		File:         path.Join(layerDir, fsMetaFile),
 		GzipIndex:    gzipIndexPath,
 	})
@@ -151,23 +166,16 @@ func (e *turboOCIBuilderEngine) UploadLayer(ctx context.Context, idx int) error
 		label.OverlayBDVersion:    version.TurboOCIVersionNumber,
 		label.OverlayBDBlobDigest: desc.Digest.String(),
 		label.OverlayBDBlobSize:   fmt.Sprintf("%d", desc.Size),
-		label.TurboOCIDigest:      e.manifest.Layers[idx].Digest.String(),
-	}
-	targetMediaType := ""
-	if images.IsDockerType(e.manifest.Layers[idx].MediaType) {
-		if e.isGzip[idx] {
-			targetMediaType = images.MediaTypeDockerSchema2LayerGzip
-		} else {
-			targetMediaType = images.MediaTypeDockerSchema2Layer
-		}
-	} else {
-		if e.isGzip[idx] {
-			targetMediaType = specs.MediaTypeImageLayerGzip
-		} else {
-			targetMediaType = specs.MediaTypeImageLayer
+		label.TurboOCIDigest:      e.targetLayers[idx].Digest.String(),
+		label.TurboOCIMediaType:   e.targetMediaType(idx),
+	}
+	if e.isZstd(idx) {
+		target := e.targetLayers[idx]
+		target.MediaType = e.targetMediaType(idx)
+		if err := uploadBlob(ctx, e.pusher, path.Join(layerDir, "layer.tar"), target); err != nil {
+			return errors.Wrapf(err, "failed to upload decompressed data of layer %d", idx)
 		}
 	}
-	desc.Annotations[label.TurboOCIMediaType] = targetMediaType
 	if err := uploadBlob(ctx, e.pusher, path.Join(layerDir, tociLayerTar), desc); err != nil {
 		return errors.Wrapf(err, "failed to upload layer %d", idx)
 	}
@@ -202,6 +210,9 @@ func (e *turboOCIBuilderEngine) UploadImage(ctx context.Context) (specs.Descript
 		e.manifest.Layers = append([]specs.Descriptor{baseDesc}, e.manifest.Layers...)
 		e.config.RootFS.DiffIDs = append([]digest.Digest{baseDesc.Digest}, e.config.RootFS.DiffIDs...)
 	}
+	if err := e.appendAccelerationLayer(ctx); err != nil {
+		return specs.Descriptor{}, err
+	}
 	if e.referrer {
 		e.manifest.ArtifactType = ArtifactTypeTurboOCI
 		e.manifest.Subject = &specs.Descriptor{
@@ -214,21 +225,67 @@ func (e *turboOCIBuilderEngine) UploadImage(ctx context.Context) (specs.Descript
 }
 
 // Layer deduplication in FastOCI is not currently supported due to conversion not
-// being reproducible at the moment which can lead to occasional bugs.
+// being reproducible at the moment which can lead to occasional bugs. Only the
+// local cache is used, the fs meta doesn't need to be identical across hosts there.
 
-// CheckForConvertedLayer TODO
+// CheckForConvertedLayer looks for the fs meta of the layer in the local cache
 func (e *turboOCIBuilderEngine) CheckForConvertedLayer(ctx context.Context, idx int) (specs.Descriptor, error) {
-	return specs.Descriptor{}, errdefs.ErrNotFound
+	if e.cache == nil {
+		return specs.Descriptor{}, errdefs.ErrNotFound
+	}
+	files, ok := e.cache.Lookup(ctx, e.cacheKey(idx))
+	if !ok {
+		return specs.Descriptor{}, errdefs.ErrNotFound
+	}
+	f, ok := files[e.fsMetaFile()]
+	if !ok {
+		return specs.Descriptor{}, errdefs.ErrNotFound
+	}
+	log.G(ctx).Infof("layer %d found in cache with chainID %s", idx, e.chainIDs[idx])
+	return specs.Descriptor{
+		Digest: f.Digest,
+		Size:   f.Size,
+	}, nil
 }
 
-// StoreConvertedLayerDetails TODO
+// StoreConvertedLayerDetails stores the fs meta of the layer in the local cache
 func (e *turboOCIBuilderEngine) StoreConvertedLayerDetails(ctx context.Context, idx int) error {
+	if e.cache == nil || e.fromCache[idx] {
+		return nil
+	}
+	layerDir := e.getLayerDir(idx)
+	files := []string{path.Join(layerDir, e.fsMetaFile())}
+	if e.isGzip(idx) {
+		files = append(files, path.Join(layerDir, gzipMetaFile))
+	}
+	if err := e.cache.Store(ctx, e.cacheKey(idx), files...); err != nil {
+		log.G(ctx).Warnf("failed to store layer %d in cache: %v", idx, err)
+	}
 	return nil
 }
 
-// DownloadConvertedLayer TODO
+// DownloadConvertedLayer restores the fs meta of the layer from the local cache.
+// The source layer is still downloaded since it's the data of turboOCI.
 func (e *turboOCIBuilderEngine) DownloadConvertedLayer(ctx context.Context, idx int, desc specs.Descriptor) error {
-	return errdefs.ErrNotImplemented
+	layerDir := e.getLayerDir(idx)
+	err := e.cache.Restore(ctx, e.cacheKey(idx), layerDir)
+	if err == nil {
+		err = e.DownloadLayer(ctx, idx)
+	}
+	if err == nil && e.isGzip(idx) {
+		if _, err = os.Stat(path.Join(layerDir, gzipMetaFile)); err != nil {
+			err = errors.Wrapf(err, "gzip meta of layer %d is missing in cache", idx)
+		}
+	}
+	if err != nil {
+		// restored files may be hard links to the cache, remove them before
+		// falling back to conversion
+		os.Remove(path.Join(layerDir, e.fsMetaFile()))
+		os.Remove(path.Join(layerDir, gzipMetaFile))
+		return err
+	}
+	e.fromCache[idx] = true
+	return nil
 }
 
 // DownloadConvertedLayer TODO
@@ -247,6 +304,43 @@ func (e *turboOCIBuilderEngine) Cleanup() {
 	}
 }
 
+func (e *turboOCIBuilderEngine) isGzip(idx int) bool {
+	return e.compress[idx] == compression.Gzip
+}
+
+func (e *turboOCIBuilderEngine) isZstd(idx int) bool {
+	return e.compress[idx] == compression.Zstd
+}
+
+// targetMediaType is the media type of the data referred by the turboOCI
+// layer, it keeps the docker/oci flavor of the source layer.
+func (e *turboOCIBuilderEngine) targetMediaType(idx int) string {
+	docker := images.IsDockerType(e.manifest.Layers[idx].MediaType)
+	switch {
+	case e.isGzip(idx) && docker:
+		return images.MediaTypeDockerSchema2LayerGzip
+	case e.isGzip(idx):
+		return specs.MediaTypeImageLayerGzip
+	case docker:
+		return images.MediaTypeDockerSchema2Layer
+	default:
+		return specs.MediaTypeImageLayer
+	}
+}
+
+func (e *turboOCIBuilderEngine) fsMetaFile() string {
+	if e.fstype == "" {
+		return "ext4" + fsMetaFileSuffix
+	}
+	return e.fstype + fsMetaFileSuffix
+}
+
+// cacheKey covers the options changing the content of the fs meta
+func (e *turboOCIBuilderEngine) cacheKey(idx int) string {
+	profile := fmt.Sprintf("turboOCI;version=%s;fstype=%s;mkfs=%v;vsize=%d", version.TurboOCIVersionNumber, e.fstype, e.mkfs, e.vsize)
+	return cache.Key(profile, e.chainIDs[idx])
+}
+
 func (e *turboOCIBuilderEngine) getLayerDir(idx int) string {
 	return path.Join(e.workDir, fmt.Sprintf("%04d_", idx)+e.manifest.Layers[idx].Digest.String())
 }
@@ -269,7 +363,7 @@ func (e *turboOCIBuilderEngine) create(ctx context.Context, idx int) error {
 	opts := []string{"-s", fmt.Sprintf("%d", vsizeGB), "--turboOCI"}
 
 	if e.mkfs && idx == 0 {
-		logrus.Infof("mkfs for baselayer, vsize: %d GB", vsizeGB)
+		log.G(ctx).Infof("mkfs for baselayer, vsize: %d GB", vsizeGB)
 		if e.fstype != "erofs" {
 			opts = append(opts, "--mkfs")
 		}
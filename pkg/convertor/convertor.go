@@ -27,11 +27,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/containerd/accelerated-container-image/pkg/database"
 	"github.com/containerd/accelerated-container-image/pkg/label"
 	"github.com/containerd/accelerated-container-image/pkg/utils"
 	"github.com/containerd/accelerated-container-image/pkg/version"
@@ -220,14 +222,23 @@ type overlaybdConvertor struct {
 	remote   bool
 	fetcher  remotes.Fetcher
 	pusher   remotes.Pusher
-	db       *sql.DB
+	db       database.ConversionDatabase
+	leases   *database.LayerLeases
+	resolver remotes.Resolver
 	host     string
 	repo     string
 	zfileCfg ZFileConfig
 	vsize    int
 }
 
-func NewOverlaybdConvertor(ctx context.Context, cs content.Store, sn snapshots.Snapshotter, resolver remotes.Resolver, ref string, dbstr string, zfileCfg ZFileConfig, vsize int) (ImageConvertor, error) {
+// NewOverlaybdConvertor creates a convertor of images in ref. If db is not nil,
+// converted layers and manifests are recorded in db and pushed to the registry
+// of ref, so that they can be reused by later conversions.
+func NewOverlaybdConvertor(ctx context.Context, cs content.Store, sn snapshots.Snapshotter, resolver remotes.Resolver, ref string, db database.ConversionDatabase, zfileCfg ZFileConfig, vsize int) (ImageConvertor, error) {
+	return newOverlaybdConvertor(ctx, cs, sn, resolver, ref, db, zfileCfg, vsize)
+}
+
+func newOverlaybdConvertor(ctx context.Context, cs content.Store, sn snapshots.Snapshotter, resolver remotes.Resolver, ref string, db database.ConversionDatabase, zfileCfg ZFileConfig, vsize int) (*overlaybdConvertor, error) {
 	c := &overlaybdConvertor{
 		cs:       cs,
 		sn:       sn,
@@ -236,12 +247,10 @@ func NewOverlaybdConvertor(ctx context.Context, cs content.Store, sn snapshots.S
 		vsize:    vsize,
 	}
 	var err error
-	if dbstr != "" {
+	if db != nil {
 		c.remote = true
-		c.db, err = sql.Open("mysql", dbstr)
-		if err != nil {
-			return nil, err
-		}
+		c.db = db
+		c.resolver = resolver
 		c.pusher, err = resolver.Pusher(ctx, ref)
 		if err != nil {
 			return nil, err
@@ -256,6 +265,7 @@ func NewOverlaybdConvertor(ctx context.Context, cs content.Store, sn snapshots.S
 		}
 		c.host = refspec.Hostname()
 		c.repo = strings.TrimPrefix(refspec.Locator, c.host+"/")
+		c.leases = database.NewLayerLeases(db, c.host)
 	}
 	return c, nil
 }
@@ -279,6 +289,59 @@ func (c *overlaybdConvertor) Convert(ctx context.Context, srcManifest ocispec.Ma
 	return c.commitImage(ctx, srcManifest, srcCfg, committedLayers)
 }
 
+// convertManifest converts the manifest src like Convert, the result of a
+// previous conversion recorded in db is reused if any.
+func (c *overlaybdConvertor) convertManifest(ctx context.Context, src ocispec.Descriptor, fsType string) (ocispec.Descriptor, error) {
+	if c.remote {
+		desc, err := c.findRemoteManifest(ctx, src)
+		if err == nil {
+			return desc, nil
+		}
+		if !errdefs.IsNotFound(err) {
+			log.G(ctx).Warnf("failed to find converted manifest, err: %v", err)
+		}
+	}
+
+	mb, err := content.ReadBlob(ctx, c.cs, src)
+	if err != nil {
+		return emptyDesc, err
+	}
+	var srcManifest ocispec.Manifest
+	if err := json.Unmarshal(mb, &srcManifest); err != nil {
+		return emptyDesc, err
+	}
+	desc, err := c.Convert(ctx, srcManifest, fsType)
+	if err != nil {
+		return emptyDesc, err
+	}
+	if c.remote {
+		if err := c.db.CreateManifestEntry(ctx, c.host, c.repo, desc.MediaType, src.Digest, desc.Digest, desc.Size); err != nil {
+			log.G(ctx).Warnf("failed to insert manifest to db, err: %v", err)
+		}
+	}
+	return desc, nil
+}
+
+// platformManifest returns the descriptor of the manifest images.Manifest
+// would pick for platform.
+func platformManifest(ctx context.Context, provider content.Provider, target ocispec.Descriptor, platform platforms.MatchComparer) (ocispec.Descriptor, error) {
+	var found []ocispec.Descriptor
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if images.IsManifestType(desc.MediaType) {
+			found = append(found, desc)
+			return nil, nil
+		}
+		return images.Children(ctx, provider, desc)
+	})
+	if err := images.Walk(ctx, images.LimitManifests(handler, platform, 1), target); err != nil {
+		return emptyDesc, err
+	}
+	if len(found) == 0 {
+		return emptyDesc, errors.Wrap(errdefs.ErrNotFound, "no manifest matching the platform")
+	}
+	return found[0], nil
+}
+
 func (c *overlaybdConvertor) commitImage(ctx context.Context, srcManifest ocispec.Manifest, imgCfg ocispec.Image, committedLayers []Layer) (ocispec.Descriptor, error) {
 	var copyManifest = struct {
 		ocispec.Manifest `json:",omitempty"`
@@ -350,23 +413,14 @@ func (c *overlaybdConvertor) commitImage(ctx context.Context, srcManifest ocispe
 	return desc, nil
 }
 
-type OverlaybdLayer struct {
-	Host       string
-	Repo       string
-	ChainID    string
-	DataDigest string
-	DataSize   int64
-}
-
 func (c *overlaybdConvertor) findRemote(ctx context.Context, chainID string) (ocispec.Descriptor, error) {
-	row := c.db.QueryRow("select host, repo, chain_id, data_digest, data_size from overlaybd_layers where host=? and repo=? and chain_id=?", c.host, c.repo, chainID)
 	// try to find in the same repo, check existence on registry
-	var layer OverlaybdLayer
-	if err := row.Scan(&layer.Host, &layer.Repo, &layer.ChainID, &layer.DataDigest, &layer.DataSize); err == nil {
+	entry := c.db.GetLayerEntryForRepo(ctx, c.host, c.repo, chainID)
+	if entry != nil && entry.ChainID != "" {
 		desc := ocispec.Descriptor{
 			MediaType: ocispec.MediaTypeImageLayer,
-			Digest:    digest.Digest(layer.DataDigest),
-			Size:      layer.DataSize,
+			Digest:    entry.ConvertedDigest,
+			Size:      entry.DataSize,
 		}
 		rc, err := c.fetcher.Fetch(ctx, desc)
 		if err == nil {
@@ -376,45 +430,29 @@ func (c *overlaybdConvertor) findRemote(ctx context.Context, chainID string) (oc
 		}
 		if errdefs.IsNotFound(err) {
 			// invalid record in db, which is not found in registry, remove it
-			_, err := c.db.Exec("delete from overlaybd_layers where host=? and repo=? and chain_id=?", c.host, c.repo, chainID)
-			if err != nil {
-				return emptyDesc, errors.Wrapf(err, "failed to remove invalid record in db")
+			if err := c.db.DeleteLayerEntry(ctx, c.host, c.repo, chainID); err != nil {
+				return emptyDesc, err
 			}
 		}
 	}
 
 	// found record in other repo, mount it to target repo
-	rows, err := c.db.Query("select host, repo, chain_id, data_digest, data_size from overlaybd_layers where host=? and chain_id=?", c.host, chainID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return emptyDesc, errdefs.ErrNotFound
-		}
-		log.G(ctx).Infof("query error %v", err)
-		return emptyDesc, err
-	}
-	for rows.Next() {
-		var layer OverlaybdLayer
-		err = rows.Scan(&layer.Host, &layer.Repo, &layer.ChainID, &layer.DataDigest, &layer.DataSize)
-		if err != nil {
-			continue
-		}
-		// try mount
+	for _, entry := range c.db.GetCrossRepoLayerEntries(ctx, c.host, chainID) {
 		desc := ocispec.Descriptor{
 			MediaType: ocispec.MediaTypeImageLayer,
-			Digest:    digest.Digest(layer.DataDigest),
-			Size:      layer.DataSize,
+			Digest:    entry.ConvertedDigest,
+			Size:      entry.DataSize,
 			Annotations: map[string]string{
-				fmt.Sprintf("%s.%s", labelDistributionSource, c.host): layer.Repo,
+				distributionSourceLabel(c.host): entry.Repository,
 			},
 		}
 		_, err := c.pusher.Push(ctx, desc)
 		if errdefs.IsAlreadyExists(err) {
 			desc.Annotations = nil
-			_, err := c.db.Exec("insert into overlaybd_layers(host, repo, chain_id, data_digest, data_size) values(?, ?, ?, ?, ?)", c.host, c.repo, chainID, desc.Digest.String(), desc.Size)
-			if err != nil {
+			if err := c.db.CreateLayerEntry(ctx, c.host, c.repo, desc.Digest, chainID, desc.Size); err != nil {
 				continue
 			}
-			log.G(ctx).Infof("mount from %s success", layer.Repo)
+			log.G(ctx).Infof("mount from %s success", entry.Repository)
 			log.G(ctx).Infof("found remote layer for chainID %s", chainID)
 			return desc, nil
 		}
@@ -423,6 +461,133 @@ func (c *overlaybdConvertor) findRemote(ctx context.Context, chainID string) (oc
 	return emptyDesc, errdefs.ErrNotFound
 }
 
+// findOrLeaseRemote finds the converted layer like findRemote. If it's being
+// converted by another process, wait for the result. If nobody is converting
+// it, ErrNotFound is returned with the lease taken, until sentToRemote.
+func (c *overlaybdConvertor) findOrLeaseRemote(ctx context.Context, chainID, profile string) (ocispec.Descriptor, error) {
+	desc, err := c.findRemote(ctx, chainID)
+	if !errdefs.IsNotFound(err) {
+		return desc, err
+	}
+	return c.leases.AcquireOrWait(ctx, chainID, profile, func(ctx context.Context) (ocispec.Descriptor, error) {
+		return c.findRemote(ctx, chainID)
+	})
+}
+
+// findRemoteManifest finds the manifest converted from src, the manifest and
+// its config are stored in the content store like a converted one.
+func (c *overlaybdConvertor) findRemoteManifest(ctx context.Context, src ocispec.Descriptor) (ocispec.Descriptor, error) {
+	mediaType := images.MediaTypeDockerSchema2Manifest
+	// try to find in the same repo, check existence on registry
+	entry := c.db.GetManifestEntryForRepo(ctx, c.host, c.repo, mediaType, src.Digest)
+	if entry != nil && entry.ConvertedDigest != "" {
+		desc := ocispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    entry.ConvertedDigest,
+			Size:      entry.DataSize,
+		}
+		_, err := c.fetchManifest(ctx, c.fetcher, desc)
+		if err == nil {
+			log.G(ctx).Infof("found remote manifest %s converted from %s", desc.Digest, src.Digest)
+			return desc, nil
+		}
+		if errdefs.IsNotFound(err) {
+			// invalid record in db, which is not found in registry, remove it
+			if err := c.db.DeleteManifestEntry(ctx, c.host, c.repo, mediaType, src.Digest); err != nil {
+				return emptyDesc, err
+			}
+		}
+	}
+
+	// found record in other repo, mount its blobs and push it to target repo
+	for _, entry := range c.db.GetCrossRepoManifestEntries(ctx, c.host, mediaType, src.Digest) {
+		desc := ocispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    entry.ConvertedDigest,
+			Size:      entry.DataSize,
+		}
+		fetcher, err := c.resolver.Fetcher(ctx, fmt.Sprintf("%s/%s@%s", entry.Host, entry.Repository, desc.Digest))
+		if err != nil {
+			return emptyDesc, err
+		}
+		manifest, err := c.fetchManifest(ctx, fetcher, desc)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				if err := c.db.DeleteManifestEntry(ctx, entry.Host, entry.Repository, mediaType, src.Digest); err != nil {
+					return emptyDesc, err
+				}
+			}
+			continue
+		}
+		if err := c.mountManifest(ctx, manifest, desc, entry.Repository); err != nil {
+			log.G(ctx).Warnf("failed to mount manifest from %s, err: %v", entry.Repository, err)
+			continue
+		}
+		if err := c.db.CreateManifestEntry(ctx, c.host, c.repo, mediaType, src.Digest, desc.Digest, desc.Size); err != nil {
+			continue
+		}
+		log.G(ctx).Infof("mount manifest %s from %s success", desc.Digest, entry.Repository)
+		return desc, nil
+	}
+	log.G(ctx).Infof("manifest converted from %s not found in remote", src.Digest)
+	return emptyDesc, errdefs.ErrNotFound
+}
+
+// fetchManifest writes the manifest desc and its config from fetcher into the
+// content store.
+func (c *overlaybdConvertor) fetchManifest(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) (ocispec.Manifest, error) {
+	var manifest ocispec.Manifest
+	mb, err := fetchBlob(ctx, fetcher, desc)
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(mb, &manifest); err != nil {
+		return manifest, errors.Wrapf(err, "failed to unmarshal manifest %s", desc.Digest)
+	}
+	configData, err := fetchBlob(ctx, fetcher, manifest.Config)
+	if err != nil {
+		return manifest, err
+	}
+	if err := content.WriteBlob(ctx, c.cs, remotes.MakeRefKey(ctx, manifest.Config), bytes.NewReader(configData), manifest.Config); err != nil {
+		return manifest, errors.Wrap(err, "failed to write image config")
+	}
+	labels := map[string]string{}
+	labels["containerd.io/gc.ref.content.config"] = manifest.Config.Digest.String()
+	for i, ch := range manifest.Layers {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = ch.Digest.String()
+	}
+	if err := content.WriteBlob(ctx, c.cs, remotes.MakeRefKey(ctx, desc), bytes.NewReader(mb), desc, content.WithLabels(labels)); err != nil {
+		return manifest, errors.Wrap(err, "failed to write image manifest")
+	}
+	return manifest, nil
+}
+
+// mountManifest mounts the config and layers of manifest from repository, and
+// pushes the manifest to the target repo.
+func (c *overlaybdConvertor) mountManifest(ctx context.Context, manifest ocispec.Manifest, desc ocispec.Descriptor, repository string) error {
+	for _, blob := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		blob.Annotations = map[string]string{
+			distributionSourceLabel(c.host): repository,
+		}
+		if _, err := c.pusher.Push(ctx, blob); !errdefs.IsAlreadyExists(err) {
+			if err == nil {
+				err = fmt.Errorf("blob %s was not mounted", blob.Digest)
+			}
+			return err
+		}
+	}
+	return c.pushObject(ctx, desc)
+}
+
+func fetchBlob(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, desc.Size))
+}
+
 func (c *overlaybdConvertor) pushObject(ctx context.Context, desc ocispec.Descriptor) error {
 	ra, err := c.cs.ReaderAt(ctx, desc)
 	if err != nil {
@@ -447,12 +612,9 @@ func (c *overlaybdConvertor) sentToRemote(ctx context.Context, desc ocispec.Desc
 		return err
 	}
 	// update db
-	_, err = c.db.Exec("insert into overlaybd_layers(host, repo, chain_id, data_digest, data_size) values(?, ?, ?, ?, ?)", c.host, c.repo, chainID, desc.Digest.String(), desc.Size)
+	err = c.db.CreateLayerEntry(ctx, c.host, c.repo, desc.Digest, chainID, desc.Size)
 	if err != nil {
 		log.G(ctx).Warnf("failed to insert to db, err: %v", err)
-		if strings.Contains(err.Error(), "Duplicate entry") {
-			fmt.Printf("Conflict when inserting into db, maybe other process is converting the same blob, please try again later\n")
-		}
 		return err
 	}
 	return nil
@@ -480,6 +642,12 @@ func (c *overlaybdConvertor) convertLayers(ctx context.Context, srcDescs []ocisp
 		return loader.Load(ctx, c.cs)
 	}
 
+	profile := fmt.Sprintf("overlaybd;version=%s;fstype=%s;vsize=%d", version.OverlayBDVersionNumber, fsType, c.vsize)
+	if c.remote {
+		// give up the leases on failure, so that others don't wait for their expiration
+		defer c.leases.ReleaseAll(context.Background())
+	}
+
 	eg, ctx := errgroup.WithContext(ctx)
 	for idx, desc := range srcDescs {
 		chain = append(chain, srcDiffIDs[idx])
@@ -488,7 +656,7 @@ func (c *overlaybdConvertor) convertLayers(ctx context.Context, srcDescs []ocisp
 		var remoteDesc ocispec.Descriptor
 
 		if c.remote {
-			remoteDesc, err = c.findRemote(ctx, chainID)
+			remoteDesc, err = c.findOrLeaseRemote(ctx, chainID, profile)
 			if err != nil {
 				if !errdefs.IsNotFound(err) {
 					return nil, err
@@ -560,6 +728,7 @@ func (c *overlaybdConvertor) convertLayers(ctx context.Context, srcDescs []ocisp
 			if err != nil {
 				return nil, err
 			}
+			c.leases.Release(ctx, chainID, profile)
 		} else {
 			idxI := idx
 			snID := lastParentID
@@ -680,6 +849,7 @@ func (wc *writeCountWrapper) Write(p []byte) (n int, err error) {
 type options struct {
 	fsType    string
 	dbstr     string
+	db        database.ConversionDatabase
 	imgRef    string
 	algorithm string
 	blockSize int
@@ -697,6 +867,8 @@ func WithFsType(fsType string) Option {
 	}
 }
 
+// WithDbstr uses the mysql database of dbstr for deduplication, the mysql
+// driver must be registered by the caller.
 func WithDbstr(dbstr string) Option {
 	return func(o *options) error {
 		o.dbstr = dbstr
@@ -704,6 +876,14 @@ func WithDbstr(dbstr string) Option {
 	}
 }
 
+// WithDatabase uses db for deduplication, it takes precedence over WithDbstr.
+func WithDatabase(db database.ConversionDatabase) Option {
+	return func(o *options) error {
+		o.db = db
+		return nil
+	}
+}
+
 func WithImageRef(imgRef string) Option {
 	return func(o *options) error {
 		o.imgRef = imgRef
@@ -763,22 +943,40 @@ func IndexConvertFunc(opts ...Option) converter.ConvertFunc {
 			return nil, err
 		}
 
-		srcManifest, err := images.Manifest(ctx, cs, srcImg.Target(), platforms.Default())
+		srcDesc, err := platformManifest(ctx, cs, srcImg.Target(), platforms.Default())
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to read manifest")
 		}
+		db := copts.db
+		if db == nil && copts.dbstr != "" {
+			sqldb, err := sql.Open("mysql", copts.dbstr)
+			if err != nil {
+				return nil, err
+			}
+			defer sqldb.Close()
+			db = database.NewSqlDB(sqldb)
+		}
 		zfileCfg := ZFileConfig{
 			Algorithm: copts.algorithm,
 			BlockSize: copts.blockSize,
 		}
-		c, err := NewOverlaybdConvertor(ctx, cs, sn, copts.resolver, imgRef, copts.dbstr, zfileCfg, copts.vsize)
+		c, err := newOverlaybdConvertor(ctx, cs, sn, copts.resolver, imgRef, db, zfileCfg, copts.vsize)
 		if err != nil {
 			return nil, err
 		}
-		newMfstDesc, err := c.Convert(ctx, srcManifest, copts.fsType)
+		newMfstDesc, err := c.convertManifest(ctx, srcDesc, copts.fsType)
 		if err != nil {
 			return nil, err
 		}
 		return &newMfstDesc, nil
 	}
 }
+
+// distributionSourceLabel returns the annotation of the repositories a blob can
+// be mounted from. Like containerd, it's keyed by the registry host without port.
+func distributionSourceLabel(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return fmt.Sprintf("%s.%s", labelDistributionSource, host)
+}
@@ -18,6 +18,7 @@ package database
 
 import (
 	"context"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 )
@@ -34,6 +35,13 @@ type ConversionDatabase interface {
 	GetManifestEntryForRepo(ctx context.Context, host, repository, mediatype string, original digest.Digest) *ManifestEntry
 	GetCrossRepoManifestEntries(ctx context.Context, host, mediatype string, original digest.Digest) []*ManifestEntry
 	DeleteManifestEntry(ctx context.Context, host, repository, mediatype string, original digest.Digest) error
+
+	// Layer Leases
+	// AcquireLayerLease takes the lease of converting the layer chainID with profile on host
+	// for owner until ttl expires. It returns false if another owner holds an unexpired lease.
+	// An owner acquiring its own lease again extends it.
+	AcquireLayerLease(ctx context.Context, host, chainID, profile, owner string, ttl time.Duration) (bool, error)
+	ReleaseLayerLease(ctx context.Context, host, chainID, profile, owner string) error
 }
 
 type LayerEntry struct {
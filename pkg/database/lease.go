@@ -0,0 +1,180 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	DefaultLeaseTTL  = 2 * time.Minute
+	DefaultLeasePoll = 5 * time.Second
+)
+
+// LayerLeases makes sure a layer is converted by one worker at a time. The
+// lease of a layer is held while converting it and renewed periodically, so
+// the lease of a crashed worker expires and can be reclaimed by another one.
+type LayerLeases struct {
+	db   ConversionDatabase
+	host string
+
+	// Owner identifies the holder of the leases in db
+	Owner string
+	// TTL is the expiration of the leases, they are renewed every TTL/3
+	TTL time.Duration
+	// Poll is the interval of checking the result of other workers
+	Poll time.Duration
+
+	mu   sync.Mutex
+	held map[leaseKey]context.CancelFunc // stops the renewal of a held lease
+}
+
+type leaseKey struct {
+	chainID string
+	profile string
+}
+
+// NewLayerLeases creates the leases of layers in registry host. The owner is
+// unique per call, as several images may be converted concurrently in the same
+// process.
+func NewLayerLeases(db ConversionDatabase, host string) *LayerLeases {
+	return &LayerLeases{
+		db:    db,
+		host:  host,
+		Owner: leaseOwner(),
+		TTL:   DefaultLeaseTTL,
+		Poll:  DefaultLeasePoll,
+		held:  make(map[leaseKey]context.CancelFunc),
+	}
+}
+
+func leaseOwner() string {
+	hostname, _ := os.Hostname()
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(b))
+}
+
+// AcquireOrWait returns the converted layer found by find, waiting for other
+// workers converting the same layer. ErrNotFound is returned when the lease is
+// taken and the layer should be converted by the caller.
+func (l *LayerLeases) AcquireOrWait(ctx context.Context, chainID, profile string, find func(ctx context.Context) (specs.Descriptor, error)) (specs.Descriptor, error) {
+	for waiting := false; ; waiting = true {
+		acquired, err := l.acquire(ctx, chainID, profile)
+		if err != nil {
+			log.G(ctx).Warnf("failed to acquire lease of layer %s, converting without it: %v", chainID, err)
+			return specs.Descriptor{}, errdefs.ErrNotFound
+		}
+		// the previous holder may have finished since the last lookup
+		desc, err := find(ctx)
+		if acquired {
+			if err == nil {
+				l.Release(ctx, chainID, profile)
+			}
+			return desc, err
+		}
+		if !errdefs.IsNotFound(err) {
+			return desc, err
+		}
+		if !waiting {
+			log.G(ctx).Infof("layer %s is being converted by another worker, waiting", chainID)
+		}
+		select {
+		case <-ctx.Done():
+			return specs.Descriptor{}, ctx.Err()
+		case <-time.After(l.Poll):
+		}
+	}
+}
+
+func (l *LayerLeases) acquire(ctx context.Context, chainID, profile string) (bool, error) {
+	acquired, err := l.db.AcquireLayerLease(ctx, l.host, chainID, profile, l.Owner, l.TTL)
+	if err != nil || !acquired {
+		return false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := leaseKey{chainID, profile}
+	if _, ok := l.held[key]; ok {
+		return true, nil
+	}
+	rctx, cancel := context.WithCancel(context.Background())
+	l.held[key] = cancel
+	go l.renew(rctx, chainID, profile)
+	return true, nil
+}
+
+func (l *LayerLeases) renew(ctx context.Context, chainID, profile string) {
+	ticker := time.NewTicker(l.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			acquired, err := l.db.AcquireLayerLease(ctx, l.host, chainID, profile, l.Owner, l.TTL)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.G(ctx).Warnf("failed to renew lease of layer %s: %v", chainID, err)
+			} else if !acquired {
+				log.G(ctx).Warnf("lease of layer %s has been taken by another worker", chainID)
+			}
+		}
+	}
+}
+
+// Release gives up the lease, so that waiting workers can proceed
+func (l *LayerLeases) Release(ctx context.Context, chainID, profile string) {
+	l.mu.Lock()
+	key := leaseKey{chainID, profile}
+	cancel, ok := l.held[key]
+	delete(l.held, key)
+	l.mu.Unlock()
+	if !ok {
+		return
+	}
+	cancel()
+	if err := l.db.ReleaseLayerLease(ctx, l.host, chainID, profile, l.Owner); err != nil {
+		log.G(ctx).Warnf("failed to release lease of layer %s: %v", chainID, err)
+	}
+}
+
+// ReleaseAll gives up the leases still held, e.g. of layers failed to convert
+func (l *LayerLeases) ReleaseAll(ctx context.Context) {
+	l.mu.Lock()
+	keys := make([]leaseKey, 0, len(l.held))
+	for key := range l.held {
+		keys = append(keys, key)
+	}
+	l.mu.Unlock()
+	for _, key := range keys {
+		l.Release(ctx, key.chainID, key.profile)
+	}
+}
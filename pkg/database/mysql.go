@@ -20,6 +20,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/containerd/log"
 	"github.com/opencontainers/go-digest"
@@ -122,3 +123,35 @@ func (m *sqldb) DeleteManifestEntry(ctx context.Context, host, repository, media
 	}
 	return nil
 }
+
+func (m *sqldb) AcquireLayerLease(ctx context.Context, host, chainID, profile, owner string, ttl time.Duration) (bool, error) {
+	// the clock of the db is used, so that workers don't need synchronized clocks
+	expire := ttl.Microseconds()
+	// reclaim an expired lease or extend our own one
+	res, err := m.db.ExecContext(ctx, "update overlaybd_leases set owner=?, expire_at=date_add(now(3), interval ? microsecond) where host=? and chain_id=? and profile=? and (owner=? or expire_at<now(3))",
+		owner, expire, host, chainID, profile, owner)
+	if err != nil {
+		return false, fmt.Errorf("failed to update lease: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return true, nil
+	}
+	res, err = m.db.ExecContext(ctx, "insert ignore into overlaybd_leases(host, chain_id, profile, owner, expire_at) values(?, ?, ?, ?, date_add(now(3), interval ? microsecond))",
+		host, chainID, profile, owner, expire)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert lease: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (m *sqldb) ReleaseLayerLease(ctx context.Context, host, chainID, profile, owner string) error {
+	_, err := m.db.ExecContext(ctx, "delete from overlaybd_leases where host=? and chain_id=? and profile=? and owner=?", host, chainID, profile, owner)
+	if err != nil {
+		return fmt.Errorf("failed to release lease: %w", err)
+	}
+	return nil
+}
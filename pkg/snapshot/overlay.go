@@ -29,6 +29,7 @@ import (
 
 	"github.com/containerd/accelerated-container-image/pkg/label"
 	"github.com/containerd/accelerated-container-image/pkg/snapshot/diskquota"
+	"github.com/containerd/accelerated-container-image/pkg/utils"
 
 	mylog "github.com/containerd/accelerated-container-image/internal/log"
 	"github.com/containerd/accelerated-container-image/pkg/metrics"
@@ -85,19 +86,20 @@ type Registry struct {
 }
 
 type BootConfig struct {
-	Address           string                 `json:"address"`
-	Root              string                 `json:"root"`
-	LogLevel          string                 `json:"verbose"`
-	LogReportCaller   bool                   `json:"logReportCaller"`
-	RwMode            string                 `json:"rwMode"` // overlayfs, dir or dev
-	AutoRemoveDev     bool                   `json:"autoRemoveDev"`
-	ExporterConfig    metrics.ExporterConfig `json:"exporterConfig"`
-	WritableLayerType string                 `json:"writableLayerType"` // append or sparse
-	MirrorRegistry    []Registry             `json:"mirrorRegistry"`
-	DefaultFsType     string                 `json:"defaultFsType"`
-	RootfsQuota       string                 `json:"rootfsQuota"` // "20g" rootfs quota, only effective when rwMode is 'overlayfs'
-	Tenant            int                    `json:"tenant"`      // do not set this if only a single snapshotter service in the host
-	TurboFsType       []string               `json:"turboFsType"`
+	Address             string                 `json:"address"`
+	Root                string                 `json:"root"`
+	LogLevel            string                 `json:"verbose"`
+	LogReportCaller     bool                   `json:"logReportCaller"`
+	RwMode              string                 `json:"rwMode"` // overlayfs, dir or dev
+	AutoRemoveDev       bool                   `json:"autoRemoveDev"`
+	ExporterConfig      metrics.ExporterConfig `json:"exporterConfig"`
+	WritableLayerType   string                 `json:"writableLayerType"` // append or sparse
+	MirrorRegistry      []Registry             `json:"mirrorRegistry"`
+	DefaultFsType       string                 `json:"defaultFsType"`
+	RootfsQuota         string                 `json:"rootfsQuota"` // "20g" rootfs quota, only effective when rwMode is 'overlayfs'
+	Tenant              int                    `json:"tenant"`      // do not set this if only a single snapshotter service in the host
+	TurboFsType         []string               `json:"turboFsType"`
+	OverlayBDUtilBinDir string                 `json:"overlaybdUtilBinDir"` // overrides SnapshotterConfig.OverlayBDUtilBinDir if set
 }
 
 func DefaultBootConfig() *BootConfig {
@@ -136,12 +138,20 @@ type SnapshotterConfig struct {
 }
 
 var defaultConfig = SnapshotterConfig{
-	OverlayBDUtilBinDir: "/opt/overlaybd/bin",
+	OverlayBDUtilBinDir: utils.DefaultOverlayBDBinDir,
 }
 
 // Opt is an option to configure the snapshotter
 type Opt func(config *SnapshotterConfig) error
 
+// WithOverlayBDUtilBinDir sets the directory of overlaybd tools
+func WithOverlayBDUtilBinDir(dir string) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.OverlayBDUtilBinDir = dir
+		return nil
+	}
+}
+
 // snapshotter is implementation of github.com/containerd/containerd/snapshots.Snapshotter.
 //
 // It is a snapshotter plugin. The layout of root dir is organized:
@@ -202,6 +212,10 @@ func NewSnapshotter(bootConfig *BootConfig, opts ...Opt) (snapshots.Snapshotter,
 			return nil, err
 		}
 	}
+	if bootConfig.OverlayBDUtilBinDir != "" {
+		config.OverlayBDUtilBinDir = bootConfig.OverlayBDUtilBinDir
+	}
+	utils.SetOverlayBDBinDir(config.OverlayBDUtilBinDir)
 
 	if err := os.MkdirAll(bootConfig.Root, 0700); err != nil {
 		return nil, err
@@ -18,13 +18,21 @@ package snapshot
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/containerd/accelerated-container-image/pkg/utils/faketools"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/core/snapshots/testsuite"
 	"github.com/containerd/containerd/v2/pkg/testutil"
 )
 
+func TestMain(m *testing.M) {
+	faketools.Main()
+	os.Exit(m.Run())
+}
+
 func newSnapshotterWithOpts(opts ...Opt) testsuite.SnapshotterFunc {
 	return func(ctx context.Context, root string) (snapshots.Snapshotter, func() error, error) {
 		cfg := DefaultBootConfig()
@@ -42,3 +50,41 @@ func TestBasicSnapshotterOnOverlayFS(t *testing.T) {
 	testutil.RequiresRoot(t)
 	testsuite.SnapshotterSuite(t, "overlaybd-on-overlayFS", newSnapshotterWithOpts())
 }
+
+// TestSealWritableOverlaybd commits a writable overlaybd layer with faketools
+func TestSealWritableOverlaybd(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultBootConfig()
+	cfg.Root = t.TempDir()
+	cfg.WritableLayerType = "sparse"
+	sn, err := NewSnapshotter(cfg, WithOverlayBDUtilBinDir(faketools.Install(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sn.Close()
+	o := sn.(*snapshotter)
+
+	id := "1"
+	for _, dir := range []string{o.blockPath(id), o.upperPath(id)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.prepareWritableOverlaybd(ctx, id, 64); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.sealWritableOverlaybd(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(o.overlaybdSealedFilePath(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "create vsize=64 mkfs=false\nseal\n"; string(data) != expected {
+		t.Errorf("unexpected sealed file %q, expected %q", data, expected)
+	}
+	if _, err := os.Stat(filepath.Join(o.blockPath(id), "writable_data")); !os.IsNotExist(err) {
+		t.Errorf("writable data should be moved after seal, got %v", err)
+	}
+}
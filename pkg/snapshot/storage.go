@@ -542,6 +542,10 @@ func (o *snapshotter) constructOverlayBDSpec(ctx context.Context, key string, wr
 
 		configJSON.RepoBlobURL = blobPrefixURL
 		if isTurboOCI, dataDgst, compType := o.checkTurboOCI(info.Labels); isTurboOCI {
+			if isZstdLayerType(compType) {
+				// the converter uploads the decompressed tar for zstd layers
+				return errors.Errorf("turboOCI data of snapshot %s is zstd compressed, which isn't seekable", key)
+			}
 			fsmeta, _ := o.turboOCIFsMeta(id)
 			lower := sn.OverlayBDBSConfigLower{
 				Dir: o.upperPath(id),
@@ -804,6 +808,10 @@ func isGzipLayerType(mediaType string) bool {
 	return mediaType == specs.MediaTypeImageLayerGzip || mediaType == images.MediaTypeDockerSchema2LayerGzip
 }
 
+func isZstdLayerType(mediaType string) bool {
+	return mediaType == specs.MediaTypeImageLayerZstd || mediaType == images.MediaTypeDockerSchema2LayerZstd
+}
+
 func (o *snapshotter) diskUsageWithBlock(ctx context.Context, id string, stype storageType) (snapshots.Usage, error) {
 	usage := snapshots.Usage{}
 	du, err := fs.DiskUsage(ctx, o.upperPath(id))
@@ -25,17 +25,21 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	sn "github.com/containerd/accelerated-container-image/pkg/types"
 	"github.com/containerd/log"
 	"github.com/pkg/errors"
 )
 
+// DefaultOverlayBDBinDir is where overlaybd installs its tools
+const DefaultOverlayBDBinDir = "/opt/overlaybd/bin"
+
 const (
-	obdBinCreate        = "/opt/overlaybd/bin/overlaybd-create"
-	obdBinCommit        = "/opt/overlaybd/bin/overlaybd-commit"
-	obdBinApply         = "/opt/overlaybd/bin/overlaybd-apply"
-	obdBinTurboOCIApply = "/opt/overlaybd/bin/turboOCI-apply"
+	obdBinCreate        = "overlaybd-create"
+	obdBinCommit        = "overlaybd-commit"
+	obdBinApply         = "overlaybd-apply"
+	obdBinTurboOCIApply = "turboOCI-apply"
 
 	dataFile       = "writable_data"
 	idxFile        = "writable_index"
@@ -44,6 +48,34 @@ const (
 	commitFile     = "overlaybd.commit"
 )
 
+var (
+	binDirMu sync.RWMutex
+	binDir   = DefaultOverlayBDBinDir
+)
+
+// SetOverlayBDBinDir sets the directory containing overlaybd-create,
+// overlaybd-commit, overlaybd-apply and turboOCI-apply. An empty dir restores
+// DefaultOverlayBDBinDir.
+func SetOverlayBDBinDir(dir string) {
+	if dir == "" {
+		dir = DefaultOverlayBDBinDir
+	}
+	binDirMu.Lock()
+	defer binDirMu.Unlock()
+	binDir = dir
+}
+
+// OverlayBDBinDir returns the directory of overlaybd tools in use
+func OverlayBDBinDir() string {
+	binDirMu.RLock()
+	defer binDirMu.RUnlock()
+	return binDir
+}
+
+func obdBin(name string) string {
+	return filepath.Join(OverlayBDBinDir(), name)
+}
+
 type ConvertOption struct {
 	// src options
 	// (TODO) LayerPath   string // path of layer.tgz or layer.tar
@@ -88,8 +120,8 @@ func Create(ctx context.Context, dir string, opts ...string) error {
 	os.RemoveAll(dataPath)
 	os.RemoveAll(indexPath)
 	args := append([]string{dataPath, indexPath}, opts...)
-	log.G(ctx).Debugf("%s %s", obdBinCreate, strings.Join(args, " "))
-	out, err := exec.CommandContext(ctx, obdBinCreate, args...).CombinedOutput()
+	log.G(ctx).Debugf("%s %s", obdBin(obdBinCreate), strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, obdBin(obdBinCreate), args...).CombinedOutput()
 	if err != nil {
 		return errors.Wrapf(err, "failed to overlaybd-create: %s", out)
 	}
@@ -102,8 +134,8 @@ func Seal(ctx context.Context, dir, toDir string, opts ...string) error {
 		path.Join(dir, dataFile),
 		path.Join(dir, idxFile),
 	}, opts...)
-	log.G(ctx).Debugf("%s %s", obdBinCommit, strings.Join(args, " "))
-	out, err := exec.CommandContext(ctx, obdBinCommit, args...).CombinedOutput()
+	log.G(ctx).Debugf("%s %s", obdBin(obdBinCommit), strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, obdBin(obdBinCommit), args...).CombinedOutput()
 	if err != nil {
 		return errors.Wrapf(err, "failed to seal writable overlaybd: %s", out)
 	}
@@ -129,8 +161,8 @@ func Commit(ctx context.Context, dir, toDir string, sealed bool, opts ...string)
 			path.Join(toDir, commitFile),
 		}, opts...)
 	}
-	log.G(ctx).Debugf("%s %s", obdBinCommit, strings.Join(args, " "))
-	out, err := exec.CommandContext(ctx, obdBinCommit, args...).CombinedOutput()
+	log.G(ctx).Debugf("%s %s", obdBin(obdBinCommit), strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, obdBin(obdBinCommit), args...).CombinedOutput()
 	if err != nil {
 		return errors.Wrapf(err, "failed to overlaybd-commit: %s", out)
 	}
@@ -145,8 +177,8 @@ func ApplyOverlaybd(ctx context.Context, dir string, opts ...string) error {
 	args := append([]string{
 		path.Join(dir, "layer.tar"),
 		path.Join(dir, "config.json")}, opts...)
-	log.G(ctx).Debugf("%s %s", obdBinApply, strings.Join(args, " "))
-	out, err := exec.CommandContext(ctx, obdBinApply, args...).CombinedOutput()
+	log.G(ctx).Debugf("%s %s", obdBin(obdBinApply), strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, obdBin(obdBinApply), args...).CombinedOutput()
 	if err != nil {
 		return errors.Wrapf(err, "failed to overlaybd-apply[native]: %s", out)
 	}
@@ -159,8 +191,8 @@ func ApplyTurboOCI(ctx context.Context, dir, gzipMetaFile string, opts ...string
 		path.Join(dir, "layer.tar"),
 		path.Join(dir, "config.json"),
 		"--gz_index_path", path.Join(dir, gzipMetaFile)}, opts...)
-	log.G(ctx).Debugf("%s %s", obdBinApply, strings.Join(args, " "))
-	out, err := exec.CommandContext(ctx, obdBinTurboOCIApply, args...).CombinedOutput()
+	log.G(ctx).Debugf("%s %s", obdBin(obdBinTurboOCIApply), strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, obdBin(obdBinTurboOCIApply), args...).CombinedOutput()
 	if err != nil {
 		return errors.Wrapf(err, "failed to overlaybd-apply[turboOCI]: %s", out)
 	}
@@ -175,7 +207,7 @@ func GenerateTarMeta(ctx context.Context, srcTarFile string, dstTarMeta string)
 		return fmt.Errorf("error stating tar file: %w", err)
 	}
 	log.G(ctx).Infof("generate layer meta for %s", srcTarFile)
-	if err := exec.Command(obdBinTurboOCIApply, srcTarFile, dstTarMeta, "--export").Run(); err != nil {
+	if err := exec.Command(obdBin(obdBinTurboOCIApply), srcTarFile, dstTarMeta, "--export").Run(); err != nil {
 		return fmt.Errorf("failed to convert tar file to overlaybd device: %w", err)
 	}
 	return nil
@@ -202,7 +234,7 @@ func ConvertLayer(ctx context.Context, opt *ConvertOption, fs_type string) error
 	if fs_type != "erofs" && len(opt.Config.Lowers) == 0 {
 		args = append(args, "--mkfs")
 	}
-	if out, err := exec.CommandContext(ctx, obdBinCreate, args...).CombinedOutput(); err != nil {
+	if out, err := exec.CommandContext(ctx, obdBin(obdBinCreate), args...).CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to overlaybd-create: %w, output: %s", err, out)
 	}
 	file, err := os.Create(pathFakeTarget)
@@ -238,15 +270,15 @@ func ConvertLayer(ctx context.Context, opt *ConvertOption, fs_type string) error
 		args = append(args, "--import")
 	}
 
-	log.G(ctx).Debugf("%s %s", obdBinTurboOCIApply, strings.Join(args, " "))
-	if out, err := exec.CommandContext(ctx, obdBinTurboOCIApply,
+	log.G(ctx).Debugf("%s %s", obdBin(obdBinTurboOCIApply), strings.Join(args, " "))
+	if out, err := exec.CommandContext(ctx, obdBin(obdBinTurboOCIApply),
 		args...,
 	).CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to turboOCI-apply: %w, output: %s", err, out)
 	}
 
 	// overlaybd-commit
-	if out, err := exec.CommandContext(ctx, obdBinCommit,
+	if out, err := exec.CommandContext(ctx, obdBin(obdBinCommit),
 		pathWritableData,
 		pathWritableIndex,
 		opt.Ext4FSMetaPath,
@@ -0,0 +1,116 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sn "github.com/containerd/accelerated-container-image/pkg/types"
+	"github.com/containerd/accelerated-container-image/pkg/utils/faketools"
+)
+
+func TestMain(m *testing.M) {
+	faketools.Main()
+	os.Exit(m.Run())
+}
+
+func useFakeTools(t *testing.T) {
+	SetOverlayBDBinDir(faketools.Install(t))
+	t.Cleanup(func() { SetOverlayBDBinDir("") })
+}
+
+func TestSetOverlayBDBinDir(t *testing.T) {
+	SetOverlayBDBinDir("/usr/local/overlaybd/bin")
+	if got := obdBin(obdBinCommit); got != "/usr/local/overlaybd/bin/overlaybd-commit" {
+		t.Errorf("unexpected tool path %s", got)
+	}
+	SetOverlayBDBinDir("")
+	if got := OverlayBDBinDir(); got != DefaultOverlayBDBinDir {
+		t.Errorf("expected default bin dir, got %s", got)
+	}
+}
+
+func TestCreateSealCommit(t *testing.T) {
+	useFakeTools(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	toDir := t.TempDir()
+
+	if err := Create(ctx, dir, "64", "-s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Seal(ctx, dir, toDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, idxFile)); !os.IsNotExist(err) {
+		t.Errorf("index should be removed after seal, got %v", err)
+	}
+	if err := Commit(ctx, toDir, toDir, true, "-z", "-t"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(toDir, commitFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := faketools.CommitHeader + " -z -t\ncreate vsize=64 mkfs=false\nseal\n"
+	if string(data) != expected {
+		t.Errorf("unexpected commit file %q, expected %q", data, expected)
+	}
+}
+
+func TestConvertLayer(t *testing.T) {
+	useFakeTools(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	tarFile := filepath.Join(dir, "layer.tar")
+	if err := os.WriteFile(tarFile, []byte("layer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tarMeta := filepath.Join(dir, "layer.tar.meta")
+	if err := GenerateTarMeta(ctx, tarFile, tarMeta); err != nil {
+		t.Fatal(err)
+	}
+
+	convert := func() string {
+		opt := &ConvertOption{
+			TarMetaPath:    tarMeta,
+			Config:         sn.OverlayBDBSConfig{Lowers: []sn.OverlayBDBSConfigLower{}},
+			Workdir:        filepath.Join(dir, "work"),
+			Ext4FSMetaPath: filepath.Join(dir, "ext4.fs.meta"),
+		}
+		if err := ConvertLayer(ctx, opt, "ext4"); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(opt.Ext4FSMetaPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	first := convert()
+	if !strings.HasPrefix(first, faketools.CommitHeader+" -z --turboOCI\ncreate vsize=256 mkfs=true\nturboOCI-apply sha256:") {
+		t.Errorf("unexpected fs meta %q", first)
+	}
+	if second := convert(); second != first {
+		t.Errorf("conversion is not deterministic: %q != %q", first, second)
+	}
+}
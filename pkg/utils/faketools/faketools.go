@@ -0,0 +1,288 @@
+/*
+   Copyright The Accelerated Container Image Authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package faketools provides fake overlaybd-create, overlaybd-apply,
+// overlaybd-commit and turboOCI-apply, so that conversion and commit can be
+// tested on machines without overlaybd installed.
+//
+// The fake tools don't produce block devices. The writable data file is a
+// text log of the operations applied to it, and a commit file is a header line
+// followed by that log, so the results only depend on the inputs and can be
+// compared by tests.
+//
+// The tools are served by the test binary itself, which has to call Main
+// before running the tests:
+//
+//	func TestMain(m *testing.M) {
+//		faketools.Main()
+//		os.Exit(m.Run())
+//	}
+//
+// Install returns a directory to be used as the overlaybd bin dir.
+package faketools
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sn "github.com/containerd/accelerated-container-image/pkg/types"
+)
+
+// CommitHeader starts every commit file written by the fake overlaybd-commit
+const CommitHeader = "fake-overlaybd-commit"
+
+var tools = map[string]func(args []string) error{
+	"overlaybd-create": create,
+	"overlaybd-apply":  apply,
+	"overlaybd-commit": commit,
+	"turboOCI-apply":   turboOCIApply,
+}
+
+// flags taking a value, the others are switches
+var valueFlags = map[string]bool{
+	"--uuid":                true,
+	"--parent-uuid":         true,
+	"--gz_index_path":       true,
+	"--fstype":              true,
+	"--service_config_path": true,
+	"--algorithm":           true,
+	"--bs":                  true,
+}
+
+// Main runs the fake tool and exits if the process is invoked as one of them,
+// otherwise it returns immediately.
+func Main() {
+	name := filepath.Base(os.Args[0])
+	tool, ok := tools[name]
+	if !ok {
+		return
+	}
+	if err := tool(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Install links the fake tools to the running test binary in a temporary
+// directory, and returns the directory.
+func Install(t testing.TB) string {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("failed to get test executable: %v", err)
+	}
+	dir := t.TempDir()
+	for name := range tools {
+		if err := os.Symlink(exe, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("failed to install %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+// parseArgs splits args into positional arguments and flags
+func parseArgs(args []string) (pos []string, flags map[string]string) {
+	flags = make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case valueFlags[arg] && i+1 < len(args):
+			flags[arg] = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "-"):
+			flags[arg] = ""
+		default:
+			pos = append(pos, arg)
+		}
+	}
+	return pos, flags
+}
+
+func fileDigest(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func appendLine(fn, format string, a ...any) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, format+"\n", a...)
+	return err
+}
+
+// loadConfig reads an overlaybd config, checking that its lowers exist
+func loadConfig(fn string) (*sn.OverlayBDBSConfig, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var config sn.OverlayBDBSConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", fn, err)
+	}
+	for _, lower := range config.Lowers {
+		if _, err := os.Stat(lower.File); err != nil {
+			return nil, fmt.Errorf("invalid lower: %w", err)
+		}
+	}
+	if config.Upper.Data == "" {
+		return nil, fmt.Errorf("no upper in config %s", fn)
+	}
+	return &config, nil
+}
+
+// create: overlaybd-create DATA INDEX [VSIZE] [-s] [--mkfs] [--turboOCI]
+func create(args []string) error {
+	pos, flags := parseArgs(args)
+	if len(pos) < 2 {
+		return fmt.Errorf("usage: overlaybd-create DATA INDEX [VSIZE]")
+	}
+	vsize := "0"
+	if len(pos) > 2 {
+		vsize = pos[2]
+	}
+	_, mkfs := flags["--mkfs"]
+	if err := os.WriteFile(pos[0], []byte(fmt.Sprintf("create vsize=%s mkfs=%v\n", vsize, mkfs)), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(pos[1], []byte("fake-overlaybd-index\n"), 0644)
+}
+
+// apply: overlaybd-apply LAYER_TAR CONFIG
+func apply(args []string) error {
+	pos, _ := parseArgs(args)
+	if len(pos) < 2 {
+		return fmt.Errorf("usage: overlaybd-apply LAYER_TAR CONFIG")
+	}
+	config, err := loadConfig(pos[1])
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(pos[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	files := 0
+	tr := tar.NewReader(f)
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("invalid layer tar %s: %w", pos[0], err)
+		}
+		files++
+	}
+	dgst, err := fileDigest(pos[0])
+	if err != nil {
+		return err
+	}
+	return appendLine(config.Upper.Data, "apply %s files=%d lowers=%d", dgst, files, len(config.Lowers))
+}
+
+// turboOCIApply has three forms:
+//
+//	turboOCI-apply LAYER CONFIG --gz_index_path GZ_INDEX [--fstype FS]
+//	turboOCI-apply LAYER TAR_META --export
+//	turboOCI-apply TAR_META CONFIG --service_config_path SERVICE --fstype FS [--import]
+func turboOCIApply(args []string) error {
+	pos, flags := parseArgs(args)
+	if len(pos) < 2 {
+		return fmt.Errorf("usage: turboOCI-apply SRC DST")
+	}
+	dgst, err := fileDigest(pos[0])
+	if err != nil {
+		return err
+	}
+	if _, ok := flags["--export"]; ok {
+		return os.WriteFile(pos[1], []byte(fmt.Sprintf("fake-tar-meta %s\n", dgst)), 0644)
+	}
+	config, err := loadConfig(pos[1])
+	if err != nil {
+		return err
+	}
+	fstype := flags["--fstype"]
+	if fstype == "" {
+		fstype = "ext4"
+	}
+	if gzIndex, ok := flags["--gz_index_path"]; ok {
+		if err := os.WriteFile(gzIndex, []byte(fmt.Sprintf("fake-gzip-index %s\n", dgst)), 0644); err != nil {
+			return err
+		}
+	}
+	return appendLine(config.Upper.Data, "turboOCI-apply %s fstype=%s lowers=%d", dgst, fstype, len(config.Lowers))
+}
+
+// commit has three forms:
+//
+//	overlaybd-commit --seal DATA INDEX
+//	overlaybd-commit --commit_sealed SEALED OUT [OPTS]
+//	overlaybd-commit DATA INDEX OUT [OPTS]
+func commit(args []string) error {
+	pos, flags := parseArgs(args)
+	var opts []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") && arg != "--seal" && arg != "--commit_sealed" {
+			opts = append(opts, arg)
+			if v := flags[arg]; v != "" {
+				opts = append(opts, v)
+			}
+		}
+	}
+	if _, ok := flags["--seal"]; ok {
+		if len(pos) < 2 {
+			return fmt.Errorf("usage: overlaybd-commit --seal DATA INDEX")
+		}
+		return appendLine(pos[0], "seal")
+	}
+	var src, dst string
+	if _, ok := flags["--commit_sealed"]; ok {
+		if len(pos) < 2 {
+			return fmt.Errorf("usage: overlaybd-commit --commit_sealed SEALED OUT")
+		}
+		src, dst = pos[0], pos[1]
+	} else {
+		if len(pos) < 3 {
+			return fmt.Errorf("usage: overlaybd-commit DATA INDEX OUT")
+		}
+		src, dst = pos[0], pos[2]
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	header := strings.TrimSpace(CommitHeader + " " + strings.Join(opts, " "))
+	return os.WriteFile(dst, append([]byte(header+"\n"), data...), 0644)
+}